@@ -0,0 +1,504 @@
+package extsort
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"sync"
+)
+
+const (
+	blockKindData  byte = 0
+	blockKindIndex byte = 1
+
+	blockRestartInterval = 16
+	blockFileHeaderSize  = 6
+	blockFileFooterSize  = 20
+
+	// maxRawBlockSize limits the size of a framed block, so corrupt lengths
+	// are detected before allocating.
+	maxRawBlockSize = 1<<31 - 1
+
+	// rawBlockReadChunk is the max number of bytes allocated ahead when a
+	// block of unverified length is read from a stream.
+	rawBlockReadChunk = 1 << 20
+)
+
+var (
+	crcTable     = crc32.MakeTable(crc32.Castagnoli)
+	rawBlockPool sync.Pool
+)
+
+// blockFileWriter writes sorted records into a file of framed,
+// independently compressed blocks followed by an index:
+//
+//	file   := header block* index footer
+//	header := magic:[4]byte version:uint8 compression:uint8
+//	block  := kind:uint8 uvarint(len(data)) data checksum:uint32
+//	data   := compressed(record*)
+//	record := uvarint(len(suffix)) uvarint(len(prefix)) uvarint(meta) suffix value
+//	index  := block of records, mapping the last key of each data block to
+//	          uvarint(offset) uvarint(size)
+//	footer := offset(index):uint64 size(index):uint64 magic:[4]byte
+//
+// The meta of a record is len(value). If kinds are enabled, the meta of data
+// records is len(value)<<2 | kind instead.
+//
+// Keys are delta encoded, each record only stores the suffix that is not
+// shared with the key of the previous record. The first and every 16th
+// record of each block are restart points and store the full key.
+type blockFileWriter struct {
+	w         io.Writer
+	magic     [4]byte
+	version   byte
+	compress  Compression
+	blockSize int
+	kinds     bool // records are tagged with a kind
+
+	offset  int64
+	size    int64
+	started bool
+
+	buf     []byte
+	scratch []byte
+	lastKey []byte
+	count   int
+	index   []byte
+}
+
+func newBlockFileWriter(w io.Writer, magic [4]byte, version byte, compress Compression, blockSize int) *blockFileWriter {
+	return &blockFileWriter{w: w, magic: magic, version: version, compress: compress, blockSize: blockSize}
+}
+
+// Reset starts a new file on w.
+func (b *blockFileWriter) Reset(w io.Writer) {
+	b.w = w
+	b.offset = 0
+	b.started = false
+	b.buf = b.buf[:0]
+	b.lastKey = b.lastKey[:0]
+	b.count = 0
+	b.index = b.index[:0]
+}
+
+// Truncate starts over on w, discarding the size of previously written
+// files.
+func (b *blockFileWriter) Truncate(w io.Writer) {
+	b.Reset(w)
+	b.size = 0
+}
+
+// Add appends a record to the current data block.
+func (b *blockFileWriter) Add(key, val []byte) error {
+	return b.AddKind(recordValue, key, val)
+}
+
+// AddKind appends a record of the given kind to the current data block. It
+// requires kinds to be enabled for kinds other than recordValue.
+func (b *blockFileWriter) AddKind(kind recordKind, key, val []byte) error {
+	if err := b.start(); err != nil {
+		return err
+	}
+
+	var shared int
+	if b.count%blockRestartInterval != 0 {
+		shared = sharedPrefixLen(b.lastKey, key)
+	}
+
+	meta := uint64(len(val))
+	if b.kinds {
+		meta = meta<<2 | uint64(kind)
+	}
+
+	n := len(b.buf)
+	b.buf = appendRecord(b.buf, key[shared:], shared, meta, val)
+	b.size += int64(len(b.buf) - n)
+	b.lastKey = append(b.lastKey[:0], key...)
+	b.count++
+
+	if len(b.buf) >= b.blockSize {
+		return b.flush()
+	}
+	return nil
+}
+
+// Close flushes pending data, writes the index block and the footer.
+func (b *blockFileWriter) Close() error {
+	if err := b.start(); err != nil {
+		return err
+	}
+	if err := b.flush(); err != nil {
+		return err
+	}
+
+	offset := b.offset
+	if err := b.writeBlock(blockKindIndex, b.index); err != nil {
+		return err
+	}
+
+	var footer [blockFileFooterSize]byte
+	binary.BigEndian.PutUint64(footer[0:], uint64(offset))
+	binary.BigEndian.PutUint64(footer[8:], uint64(b.offset-offset))
+	copy(footer[16:], b.magic[:])
+	return b.write(footer[:])
+}
+
+// Size returns the total number of uncompressed record bytes written.
+func (b *blockFileWriter) Size() int64 {
+	return b.size
+}
+
+func (b *blockFileWriter) start() error {
+	if b.started {
+		return nil
+	}
+
+	header := [blockFileHeaderSize]byte{b.magic[0], b.magic[1], b.magic[2], b.magic[3], b.version, byte(b.compress)}
+	if err := b.write(header[:]); err != nil {
+		return err
+	}
+	b.started = true
+	return nil
+}
+
+func (b *blockFileWriter) flush() error {
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	offset := b.offset
+	if err := b.writeBlock(blockKindData, b.buf); err != nil {
+		return err
+	}
+	b.buf = b.buf[:0]
+	b.count = 0
+
+	var handle [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(handle[:], uint64(offset))
+	n += binary.PutUvarint(handle[n:], uint64(b.offset-offset))
+	b.index = appendRecord(b.index, b.lastKey, 0, uint64(n), handle[:n])
+	return nil
+}
+
+func (b *blockFileWriter) writeBlock(kind byte, data []byte) error {
+	b.scratch = b.compress.compressBlock(b.scratch, data)
+
+	var head [1 + binary.MaxVarintLen64]byte
+	head[0] = kind
+	n := 1 + binary.PutUvarint(head[1:], uint64(len(b.scratch)))
+
+	var tail [4]byte
+	binary.BigEndian.PutUint32(tail[:], crc32.Checksum(b.scratch, crcTable))
+
+	for _, p := range [][]byte{head[:n], b.scratch, tail[:]} {
+		if err := b.write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *blockFileWriter) write(p []byte) error {
+	n, err := b.w.Write(p)
+	b.offset += int64(n)
+	return err
+}
+
+func appendRecord(dst, suffix []byte, shared int, meta uint64, val []byte) []byte {
+	var scratch [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(len(suffix)))
+	n += binary.PutUvarint(scratch[n:], uint64(shared))
+	n += binary.PutUvarint(scratch[n:], meta)
+	dst = append(dst, scratch[:n]...)
+	dst = append(dst, suffix...)
+	return append(dst, val...)
+}
+
+func sharedPrefixLen(a, b []byte) int {
+	n := len(a)
+	if len(b) < n {
+		n = len(b)
+	}
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	return n
+}
+
+// --------------------------------------------------------------------
+
+// blockHandle points to a block.
+type blockHandle struct {
+	lastKey []byte
+	offset  int64
+	size    int64
+}
+
+// readBlockFileHeader validates the header and returns the compression.
+func readBlockFileHeader(header []byte, magic [4]byte, version byte) (Compression, bool) {
+	if len(header) != blockFileHeaderSize || [4]byte{header[0], header[1], header[2], header[3]} != magic || header[4] != version {
+		return 0, false
+	}
+	compress := Compression(header[5])
+	return compress, compress.norm() == compress
+}
+
+// readBlockFileIndex reads the header, footer and index of a file of the
+// given size.
+func readBlockFileIndex(ra io.ReaderAt, size int64, magic [4]byte, version byte) (Compression, []blockHandle, bool, error) {
+	if size < blockFileHeaderSize+blockFileFooterSize {
+		return 0, nil, false, nil
+	}
+
+	var header [blockFileHeaderSize]byte
+	if _, err := ra.ReadAt(header[:], 0); err != nil {
+		return 0, nil, false, err
+	}
+	compress, ok := readBlockFileHeader(header[:], magic, version)
+	if !ok {
+		return 0, nil, false, nil
+	}
+
+	var footer [blockFileFooterSize]byte
+	if _, err := ra.ReadAt(footer[:], size-blockFileFooterSize); err != nil {
+		return 0, nil, false, err
+	}
+	if [4]byte{footer[16], footer[17], footer[18], footer[19]} != magic {
+		return 0, nil, false, nil
+	}
+	offset := int64(binary.BigEndian.Uint64(footer[0:]))
+	isize := int64(binary.BigEndian.Uint64(footer[8:]))
+	if offset < blockFileHeaderSize || offset+isize != size-blockFileFooterSize {
+		return 0, nil, false, nil
+	}
+
+	br := &blockReader{compress: compress}
+	index, err := br.ReadIndex(ra, offset, isize)
+	if err != nil {
+		return 0, nil, false, err
+	}
+	return compress, index, true, nil
+}
+
+// blockReader reads framed blocks.
+type blockReader struct {
+	compress Compression
+	buf      []byte
+}
+
+// ReadAt reads the block at the given position and returns its kind and
+// decompressed data, which is only valid until the next call.
+func (r *blockReader) ReadAt(ra io.ReaderAt, offset, size int64) (byte, []byte, error) {
+	if size < 1 || size > maxRawBlockSize {
+		return 0, nil, ErrCorrupt
+	}
+
+	raw := fetchRawBlock(int(size))
+	defer rawBlockPool.Put(raw)
+
+	if _, err := ra.ReadAt(*raw, offset); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+
+	kind := (*raw)[0]
+	n, sz := binary.Uvarint((*raw)[1:])
+	if sz <= 0 || len(*raw) < 1+sz+4 || uint64(len(*raw)-1-sz-4) != n {
+		return 0, nil, ErrCorrupt
+	}
+	data, err := r.decode((*raw)[1+sz:])
+	return kind, data, err
+}
+
+// ReadFrom reads the next block from a stream and returns its kind and
+// decompressed data, which is only valid until the next call.
+func (r *blockReader) ReadFrom(br *bufio.Reader) (byte, []byte, error) {
+	kind, err := br.ReadByte()
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return 0, nil, unexpectedEOF(err)
+	} else if n > maxRawBlockSize-4 {
+		return 0, nil, ErrCorrupt
+	}
+
+	raw := fetchRawBlock(0)
+	defer rawBlockPool.Put(raw)
+
+	if *raw, err = readRawBlock(br, *raw, int(n)+4); err != nil {
+		return 0, nil, unexpectedEOF(err)
+	}
+	data, err := r.decode(*raw)
+	return kind, data, err
+}
+
+// readRawBlock reads n bytes into buf. As n is not verified yet, buf is
+// grown while the data arrives instead of being allocated upfront.
+func readRawBlock(r io.Reader, buf []byte, n int) ([]byte, error) {
+	if n <= cap(buf) {
+		buf = buf[:n]
+		_, err := io.ReadFull(r, buf)
+		return buf, err
+	}
+
+	buf = buf[:0]
+	for len(buf) < n {
+		if len(buf) == cap(buf) {
+			grow := n - len(buf)
+			if grow > rawBlockReadChunk {
+				grow = rawBlockReadChunk
+			}
+			buf = append(buf, make([]byte, grow)...)[:len(buf)]
+		}
+
+		end := cap(buf)
+		if end > n {
+			end = n
+		}
+		m, err := io.ReadFull(r, buf[len(buf):end])
+		buf = buf[:len(buf)+m]
+		if err != nil {
+			return buf, err
+		}
+	}
+	return buf, nil
+}
+
+// ReadIndex reads the index block at the given position.
+func (r *blockReader) ReadIndex(ra io.ReaderAt, offset, size int64) ([]blockHandle, error) {
+	kind, data, err := r.ReadAt(ra, offset, size)
+	if err != nil {
+		return nil, err
+	} else if kind != blockKindIndex {
+		return nil, ErrCorrupt
+	}
+
+	var index []blockHandle
+	var it blockIter
+	for it.Reset(data); it.Next(); {
+		off, n := binary.Uvarint(it.val)
+		if n <= 0 {
+			return nil, ErrCorrupt
+		}
+		sz, m := binary.Uvarint(it.val[n:])
+		if m <= 0 {
+			return nil, ErrCorrupt
+		}
+		// data blocks must be located between header and index
+		if off < blockFileHeaderSize || sz > uint64(offset) || off > uint64(offset)-sz {
+			return nil, ErrCorrupt
+		}
+		index = append(index, blockHandle{
+			lastKey: append([]byte(nil), it.key...),
+			offset:  int64(off),
+			size:    int64(sz),
+		})
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	return index, nil
+}
+
+// decode verifies and decompresses data followed by a checksum.
+func (r *blockReader) decode(raw []byte) ([]byte, error) {
+	data := raw[:len(raw)-4]
+	if crc32.Checksum(data, crcTable) != binary.BigEndian.Uint32(raw[len(data):]) {
+		return nil, ErrCorrupt
+	}
+
+	buf, err := r.compress.decompressBlock(r.buf, data)
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+	r.buf = buf
+	return buf, nil
+}
+
+func fetchRawBlock(sz int) *[]byte {
+	if v := rawBlockPool.Get(); v != nil {
+		if p := v.(*[]byte); sz <= cap(*p) {
+			*p = (*p)[:sz]
+			return p
+		}
+	}
+	p := make([]byte, sz)
+	return &p
+}
+
+// --------------------------------------------------------------------
+
+// blockIter iterates over the records of a decompressed block.
+type blockIter struct {
+	kinds bool // records are tagged with a kind
+
+	data  []byte
+	pos   int
+	count int
+	key   []byte
+	val   []byte
+	kind  recordKind
+	err   error
+}
+
+func (it *blockIter) Reset(data []byte) {
+	it.data = data
+	it.pos = 0
+	it.count = 0
+	it.key = it.key[:0]
+	it.val = nil
+	it.kind = recordValue
+	it.err = nil
+}
+
+func (it *blockIter) Next() bool {
+	if it.err != nil || it.pos >= len(it.data) {
+		return false
+	}
+
+	var sizes [3]uint64
+	for i := range sizes {
+		u, n := binary.Uvarint(it.data[it.pos:])
+		if n <= 0 {
+			it.err = ErrCorrupt
+			return false
+		}
+		sizes[i] = u
+		it.pos += n
+	}
+
+	sn, pn, vn := sizes[0], sizes[1], sizes[2]
+	if it.kinds {
+		it.kind = recordKind(vn & 3)
+		vn >>= 2
+		if it.kind > recordPointer {
+			it.err = ErrCorrupt
+			return false
+		}
+	}
+	rem := uint64(len(it.data) - it.pos)
+	if pn > uint64(len(it.key)) || (pn != 0 && it.count%blockRestartInterval == 0) || sn > rem || vn > rem-sn {
+		it.err = ErrCorrupt
+		return false
+	}
+
+	it.key = append(it.key[:pn], it.data[it.pos:it.pos+int(sn)]...)
+	it.pos += int(sn)
+	it.val = it.data[it.pos : it.pos+int(vn)]
+	it.pos += int(vn)
+	it.count++
+	return true
+}
+
+// Entry returns a copy of the current record.
+func (it *blockIter) Entry() *entry {
+	ent := fetchEntry(len(it.key), len(it.val))
+	n := copy(ent.data, it.key)
+	copy(ent.data[n:], it.val)
+	ent.kind = it.kind
+	return ent
+}
@@ -10,21 +10,58 @@ type memBufferEntry struct {
 }
 
 type memBuffer struct {
-	size    int
-	ents    []memBufferEntry
-	compare Compare
+	size         int
+	seq          int
+	ents         []memBufferEntry
+	compare      Compare
+	compareValue Compare
+	stable       bool // order equal keys by insertion
+
+	// order of appended items, tracked if detectOrder is set
+	detectOrder           bool
+	ascending, descending bool
+
+	deletes bool // buffer contains tombstones
+
+	freed int // capacity of the entries released by Free or Detach
+}
+
+func newMemBuffer(opt *Options, detectOrder bool) *memBuffer {
+	return &memBuffer{
+		compare:      opt.Compare,
+		compareValue: opt.CompareValue,
+		stable:       opt.Stable,
+		detectOrder:  detectOrder,
+		ascending:    detectOrder,
+		descending:   detectOrder,
+	}
 }
 
 func (b *memBuffer) Append(key, val []byte) {
+	b.AppendKind(recordValue, key, val)
+}
+
+// AppendKind appends an entry of the given kind.
+func (b *memBuffer) AppendKind(kind recordKind, key, val []byte) {
 	ent := fetchEntry(len(key), len(val))
+	ent.kind = kind
+	if kind == recordDeleted {
+		b.deletes = true
+	}
 
 	n := copy(ent.data, key)
 	copy(ent.data[n:], val)
 
-	i := len(b.ents)
-	b.ents = append(b.ents, memBufferEntry{i, ent})
+	b.ents = append(b.ents, memBufferEntry{b.seq, ent})
+	b.seq++
 
 	b.size += len(ent.data)
+
+	if n := len(b.ents); b.detectOrder && n > 1 {
+		less := b.Less(n-1, n-2)
+		b.ascending = b.ascending && !less
+		b.descending = b.descending && less
+	}
 }
 
 func (b *memBuffer) ByteSize() int { return b.size }
@@ -32,9 +69,18 @@ func (b *memBuffer) Len() int      { return len(b.ents) }
 func (b *memBuffer) Less(i, j int) bool {
 	e1, e2 := b.ents[i], b.ents[j]
 	c := b.compare(e1.Key(), e2.Key())
+	if c == 0 && e1.Deleted() != e2.Deleted() {
+		return e1.Deleted() // tombstones first
+	}
+	if c == 0 && b.compareValue != nil {
+		c = b.compareValue(e1.Val(), e2.Val())
+	}
 	if c != 0 {
 		return c < 0
 	}
+	if b.stable {
+		return e1.i < e2.i
+	}
 	return e1.i > e2.i
 }
 func (b *memBuffer) Swap(i, j int) { b.ents[i], b.ents[j] = b.ents[j], b.ents[i] }
@@ -44,12 +90,135 @@ func (b *memBuffer) Reset() {
 		e.Release()
 	}
 	b.size = 0
+	b.seq = 0
 	b.ents = b.ents[:0]
+	b.ascending, b.descending = b.detectOrder, b.detectOrder
+	b.deletes = false
+}
+
+// ApplyDeletes removes all items of the sorted buffer that were added
+// before a tombstone with an equal key. Only the most recent tombstone of
+// each key is retained.
+func (b *memBuffer) ApplyDeletes() {
+	if !b.deletes {
+		return
+	}
+
+	var tomb *memBufferEntry
+	ents := b.ents[:0]
+	for _, e := range b.ents {
+		if tomb != nil && b.compare(e.Key(), tomb.Key()) == 0 {
+			if e.Deleted() && e.i > tomb.i {
+				tomb.entry, e.entry = e.entry, tomb.entry
+				tomb.i, e.i = e.i, tomb.i
+			}
+			if e.Deleted() || e.i < tomb.i {
+				b.size -= len(e.data)
+				e.Release()
+				continue
+			}
+		}
+
+		ents = append(ents, e)
+		if e.Deleted() {
+			tomb = &ents[len(ents)-1]
+		}
+	}
+	for i := len(ents); i < len(b.ents); i++ {
+		b.ents[i].entry = nil
+	}
+	b.ents = ents
+}
+
+// Reverse reverses the order of items.
+func (b *memBuffer) Reverse() {
+	for i, j := 0, len(b.ents)-1; i < j; i, j = i+1, j-1 {
+		b.Swap(i, j)
+	}
 }
 
 func (b *memBuffer) Free() {
 	b.Reset()
+	b.Detach()
+}
+
+// Detach returns the entries and removes them from the buffer without
+// releasing them. The capacity is remembered for Realloc.
+func (b *memBuffer) Detach() []memBufferEntry {
+	ents := b.ents
+	if n := cap(ents); n > b.freed {
+		b.freed = n
+	}
 	b.ents = nil
+	b.Reset()
+	return ents
+}
+
+// Realloc restores the capacity released by Free or Detach.
+func (b *memBuffer) Realloc() {
+	if b.ents == nil && b.freed > 0 {
+		b.ents = make([]memBufferEntry, 0, b.freed)
+	}
+}
+
+// --------------------------------------------------------------------
+
+// limitHeap is a max-heap view of a memBuffer, used to retain only the
+// smallest entries.
+type limitHeap struct{ *memBuffer }
+
+func (h limitHeap) Less(i, j int) bool { return h.memBuffer.Less(j, i) }
+func (h limitHeap) Push(x interface{}) {
+	e := x.(memBufferEntry)
+	h.ents = append(h.ents, e)
+	h.size += len(e.data)
+}
+func (h limitHeap) Pop() interface{} {
+	n := len(h.ents)
+	e := h.ents[n-1]
+	h.ents[n-1].entry = nil
+	h.ents = h.ents[:n-1]
+	h.size -= len(e.data)
+	e.Release()
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+// memSection is a section backed by sorted buffer entries.
+type memSection struct {
+	ents []memBufferEntry
+	pos  int
+}
+
+func (m *memSection) ReadNext() (*entry, error) {
+	if m.pos >= len(m.ents) {
+		return nil, nil
+	}
+	ent := m.ents[m.pos].entry
+	m.ents[m.pos].entry = nil
+	m.pos++
+	return ent, nil
+}
+
+func (m *memSection) Close() error {
+	for ; m.pos < len(m.ents); m.pos++ {
+		m.ents[m.pos].Release()
+		m.ents[m.pos].entry = nil
+	}
+	return nil
+}
+
+// copyEntries returns copies of the given entries.
+func copyEntries(ents []memBufferEntry) []memBufferEntry {
+	cp := make([]memBufferEntry, 0, len(ents))
+	for _, ent := range ents {
+		e := fetchEntry(ent.keyLen, len(ent.data)-ent.keyLen)
+		copy(e.data, ent.data)
+		e.kind = ent.kind
+		cp = append(cp, memBufferEntry{i: ent.i, entry: e})
+	}
+	return cp
 }
 
 // --------------------------------------------------------------------
@@ -60,17 +229,28 @@ type heapItem struct {
 }
 
 type minHeap struct {
-	items   []heapItem
-	compare Compare
+	items        []heapItem
+	compare      Compare
+	compareValue Compare
+	stable       bool // order equal keys by section
 }
 
 func (h *minHeap) Len() int { return len(h.items) }
 func (h *minHeap) Less(i, j int) bool {
 	a, b := h.items[i], h.items[j]
 	c := h.compare(a.Key(), b.Key())
+	if c == 0 && a.Deleted() != b.Deleted() {
+		return a.Deleted() // tombstones first
+	}
+	if c == 0 && h.compareValue != nil {
+		c = h.compareValue(a.Val(), b.Val())
+	}
 	if c != 0 {
 		return c < 0
 	}
+	if h.stable {
+		return a.section < b.section
+	}
 	return a.section > b.section
 }
 func (h *minHeap) Swap(i, j int)      { h.items[i], h.items[j] = h.items[j], h.items[i] }
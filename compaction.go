@@ -0,0 +1,170 @@
+package extsort
+
+import "errors"
+
+// compactionFanIn is the max number of adjacent runs merged at once.
+const compactionFanIn = 4
+
+var errCompactionAborted = errors.New("extsort: compaction aborted")
+
+// compaction merges adjacent runs in the background.
+type compaction struct {
+	from, n int // position of the merged runs
+	quit    chan struct{}
+	done    chan struct{}
+
+	run tempRun
+	err error
+}
+
+// scheduleCompaction applies the result of a completed compaction and starts
+// a new one if there are more than MaxRuns runs. It waits for the running
+// compaction if there are more than twice as many.
+func (s *Sorter) scheduleCompaction() error {
+	if s.opt.MaxRuns < 1 {
+		return nil
+	}
+
+	if c := s.compaction; c != nil {
+		if len(s.runs) <= 2*s.opt.MaxRuns {
+			select {
+			case <-c.done:
+			default:
+				return nil // still running
+			}
+		}
+		if err := s.finishCompaction(); err != nil {
+			return err
+		}
+	}
+	if len(s.runs) > s.opt.MaxRuns {
+		return s.startCompaction()
+	}
+	return nil
+}
+
+// startCompaction starts merging the adjacent runs with the smallest total
+// size. Runs are only appended while a compaction is running, so the
+// positions of the merged runs remain valid.
+func (s *Sorter) startCompaction() error {
+	if s.ctw == nil {
+		tw, err := newTempWriter(s.opt.WorkDir, s.opt.Compression, s.opt.KeepFiles)
+		if err != nil {
+			return err
+		}
+		s.ctw = tw
+	}
+
+	n := compactionFanIn
+	if n > len(s.runs) {
+		n = len(s.runs)
+	}
+
+	from, min := 0, int64(-1)
+	for i := 0; i+n <= len(s.runs); i++ {
+		var sum int64
+		for _, run := range s.runs[i : i+n] {
+			sum += run.size
+		}
+		if min < 0 || sum < min {
+			from, min = i, sum
+		}
+	}
+
+	c := &compaction{
+		from: from,
+		n:    n,
+		quit: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.compaction = c
+
+	// tombstones must be retained if they shadow older runs
+	tw, opt, keepDeleted := s.ctw, s.opt, from != 0
+	runs := append([]tempRun(nil), s.runs[from:from+n]...)
+	go func() {
+		defer close(c.done)
+		c.run, c.err = mergeTempRuns(tw, runs, opt, keepDeleted, c.quit)
+	}()
+	return nil
+}
+
+// finishCompaction waits for the running compaction and replaces the merged
+// runs with the result.
+func (s *Sorter) finishCompaction() error {
+	c := s.compaction
+	if c == nil {
+		return nil
+	}
+	<-c.done
+	s.compaction = nil
+
+	if c.err == errCompactionAborted {
+		return nil
+	} else if c.err != nil {
+		return c.err
+	}
+
+	runs := append(s.runs[:c.from], c.run)
+	s.runs = append(runs, s.runs[c.from+c.n:]...)
+	return nil
+}
+
+// stopCompaction aborts the running compaction, unless already completed.
+func (s *Sorter) stopCompaction() error {
+	if s.compaction == nil {
+		return nil
+	}
+
+	close(s.compaction.quit)
+	return s.finishCompaction()
+}
+
+// discardCompaction aborts the running compaction and discards the result.
+func (s *Sorter) discardCompaction() {
+	if c := s.compaction; c != nil {
+		close(c.quit)
+		<-c.done
+		s.compaction = nil
+	}
+}
+
+// mergeTempRuns merges runs into a single run, written to tw. Tombstones
+// are only written if keepDeleted is set. It returns errCompactionAborted
+// if quit is closed before completion.
+func mergeTempRuns(tw *tempWriter, runs []tempRun, opt *Options, keepDeleted bool, quit <-chan struct{}) (tempRun, error) {
+	sections, err := newTempReaders(runs, 0)
+	if err != nil {
+		return tempRun{}, err
+	}
+	iter, err := newIterator(sections, opt)
+	if err != nil {
+		return tempRun{}, err
+	}
+	defer iter.Close()
+
+	iter.keepDeleted = keepDeleted
+
+	for iter.Next() {
+		select {
+		case <-quit:
+			// complete the partial run, it is never read
+			if _, err := tw.Flush(); err != nil {
+				return tempRun{}, err
+			}
+			return tempRun{}, errCompactionAborted
+		default:
+		}
+
+		if err := tw.EncodeKind(iter.ent.kind, iter.Key(), iter.ent.Val()); err != nil {
+			return tempRun{}, err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return tempRun{}, err
+	}
+	if err := iter.Close(); err != nil {
+		return tempRun{}, err
+	}
+	return tw.Flush()
+}
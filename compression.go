@@ -1,12 +1,18 @@
 package extsort
 
 import (
+	"bytes"
 	"compress/gzip"
-	"io"
+	"sync"
 
 	"github.com/klauspost/compress/snappy"
 )
 
+var (
+	gzipWriterPool sync.Pool
+	gzipReaderPool sync.Pool
+)
+
 // Compression codec.
 type Compression uint8
 
@@ -24,40 +30,61 @@ func (c Compression) norm() Compression {
 	return c
 }
 
-func (c Compression) newReader(r io.Reader) (io.ReadCloser, error) {
+// compressBlock compresses src, reusing the capacity of dst.
+func (c Compression) compressBlock(dst, src []byte) []byte {
 	switch c {
 	case CompressionGzip:
-		return gzip.NewReader(r)
+		buf := bytes.NewBuffer(dst[:0])
+		w, ok := gzipWriterPool.Get().(*gzip.Writer)
+		if ok {
+			w.Reset(buf)
+		} else {
+			w, _ = gzip.NewWriterLevel(buf, gzip.BestSpeed)
+		}
+		_, _ = w.Write(src) // writes to bytes.Buffer cannot fail
+		_ = w.Close()
+		gzipWriterPool.Put(w)
+		return buf.Bytes()
 	case CompressionSnappy:
-		r := snappy.NewReader(r)
-		return readerNoopCloser{Reader: r}, nil
+		if n := snappy.MaxEncodedLen(len(src)); cap(dst) < n {
+			dst = make([]byte, n)
+		}
+		return snappy.Encode(dst[:cap(dst)], src)
 	}
-	return readerNoopCloser{Reader: r}, nil
+	return append(dst[:0], src...)
 }
 
-func (c Compression) newWriter(w io.Writer) compressedWriter {
+// decompressBlock decompresses src, reusing the capacity of dst.
+func (c Compression) decompressBlock(dst, src []byte) ([]byte, error) {
 	switch c {
 	case CompressionGzip:
-		wr, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
-		return wr
+		r, ok := gzipReaderPool.Get().(*gzip.Reader)
+		if ok {
+			if err := r.Reset(bytes.NewReader(src)); err != nil {
+				return nil, err
+			}
+		} else {
+			var err error
+			if r, err = gzip.NewReader(bytes.NewReader(src)); err != nil {
+				return nil, err
+			}
+		}
+		defer gzipReaderPool.Put(r)
+
+		buf := bytes.NewBuffer(dst[:0])
+		if _, err := buf.ReadFrom(r); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
 	case CompressionSnappy:
-		wr := snappy.NewBufferedWriter(w)
-		return wr
+		n, err := snappy.DecodedLen(src)
+		if err != nil {
+			return nil, err
+		}
+		if cap(dst) < n {
+			dst = make([]byte, n)
+		}
+		return snappy.Decode(dst[:cap(dst)], src)
 	}
-	return &writerNoopCloser{Writer: w}
-}
-
-type compressedWriter interface {
-	io.Writer
-	Reset(w io.Writer)
-	Close() error
+	return append(dst[:0], src...), nil
 }
-
-type readerNoopCloser struct{ io.Reader }
-
-func (readerNoopCloser) Close() error { return nil }
-
-type writerNoopCloser struct{ io.Writer }
-
-func (w *writerNoopCloser) Reset(wr io.Writer) { w.Writer = wr }
-func (*writerNoopCloser) Close() error         { return nil }
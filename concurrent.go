@@ -0,0 +1,154 @@
+package extsort
+
+import (
+	"io"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ConcurrentSorter is a sorter that is safe for concurrent use. Items are
+// added to a number of independent shards, each with its own buffer and
+// temporary file, and merged on Sort.
+//
+// The order of items with equal keys that were added by different goroutines
+// is undefined. This also applies to the item retained by Dedupe and to the
+// order of values passed to Combine.
+type ConcurrentSorter struct {
+	opt    *Options
+	shards []*sorterShard
+	vlog   *valueLog // shared by all shards
+	next   uint32
+}
+
+type sorterShard struct {
+	mu sync.Mutex
+	*Sorter
+}
+
+// NewConcurrent inits a concurrent sorter with the given number of shards,
+// GOMAXPROCS if less than 1. The BufferSize is divided between the shards.
+// The number of shards is limited, so that each buffers at least 64KiB.
+func NewConcurrent(shards int, opt *Options) *ConcurrentSorter {
+	if shards < 1 {
+		shards = runtime.GOMAXPROCS(0)
+	}
+
+	detect := opt == nil || opt.Sort == nil
+	opt = opt.norm()
+	if max := opt.BufferSize / minBufferSize; shards > max {
+		shards = max
+	}
+
+	shardOpt := *opt
+	shardOpt.BufferSize = opt.BufferSize / shards
+
+	c := &ConcurrentSorter{
+		opt:    opt,
+		shards: make([]*sorterShard, 0, shards),
+		vlog:   newValueLog(opt.WorkDir, opt.KeepFiles),
+	}
+	for i := 0; i < shards; i++ {
+		s := newSorter(&shardOpt, detect)
+		s.vlog = c.vlog
+		c.shards = append(c.shards, &sorterShard{Sorter: s})
+	}
+	return c
+}
+
+// Append appends a data chunk to the sorter.
+func (c *ConcurrentSorter) Append(data []byte) error {
+	return c.Put(data, nil)
+}
+
+// Put inserts a key value pair into the sorter. It adds the item to the
+// first shard that is not in use by another goroutine.
+func (c *ConcurrentSorter) Put(key, value []byte) error {
+	n := len(c.shards)
+	start := int(atomic.AddUint32(&c.next, 1) % uint32(n))
+	for i := 0; i < n; i++ {
+		if shard := c.shards[(start+i)%n]; shard.mu.TryLock() {
+			err := shard.Put(key, value)
+			shard.mu.Unlock()
+			return err
+		}
+	}
+
+	shard := c.shards[start]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.Put(key, value)
+}
+
+// PutReader inserts a key and a value read from r into the sorter. The value
+// is written to the shared value log before a shard is selected. See
+// Sorter.PutReader.
+func (c *ConcurrentSorter) PutReader(key []byte, r io.Reader) error {
+	if !c.opt.valueLog() {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return c.Put(key, value)
+	}
+
+	ptr, err := c.vlog.Write(r)
+	if err != nil {
+		return err
+	}
+
+	shard := c.shards[int(atomic.AddUint32(&c.next, 1)%uint32(len(c.shards)))]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	return shard.put(recordPointer, key, ptr)
+}
+
+// Sort applies the sort algorithm to all shards and returns an iterator.
+// It must not be called concurrently with Put.
+func (c *ConcurrentSorter) Sort() (*Iterator, error) {
+	var sections []section
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		secs, err := shard.sections(c.opt.BufferSize / len(c.shards))
+		shard.mu.Unlock()
+
+		if err != nil {
+			for _, sec := range sections {
+				_ = sec.Close()
+			}
+			return nil, err
+		}
+		sections = append(sections, secs...)
+	}
+
+	iter, err := newIterator(sections, c.opt)
+	if err != nil {
+		return nil, err
+	}
+	iter.vlog = c.vlog
+	return iter, nil
+}
+
+// Close stops the processing and removes temporary files.
+func (c *ConcurrentSorter) Close() (err error) {
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		if e := shard.Close(); e != nil {
+			err = e
+		}
+		shard.mu.Unlock()
+	}
+	return
+}
+
+// Size returns the buffered and written size, including values written to
+// the value log.
+func (c *ConcurrentSorter) Size() int64 {
+	sum := c.vlog.Size()
+	for _, shard := range c.shards {
+		shard.mu.Lock()
+		sum += shard.size()
+		shard.mu.Unlock()
+	}
+	return sum
+}
@@ -0,0 +1,178 @@
+package extsort_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("ConcurrentSorter", func() {
+	var workDir string
+
+	// produce adds n items from each of the given number of goroutines
+	produce := func(s *extsort.ConcurrentSorter, goroutines, n int) {
+		var wg sync.WaitGroup
+		for g := 0; g < goroutines; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer GinkgoRecover()
+				defer wg.Done()
+
+				val := bytes.Repeat([]byte{'x'}, 20)
+				for i := 0; i < n; i++ {
+					key := fmt.Sprintf("%08d", (i*7919)%n*goroutines+g)
+					Expect(s.Put([]byte(key), val)).To(Succeed())
+				}
+			}(g)
+		}
+		wg.Wait()
+	}
+
+	drain := func(s *extsort.ConcurrentSorter) ([]string, error) {
+		iter, err := s.Sort()
+		if err != nil {
+			return nil, err
+		}
+		defer iter.Close()
+
+		var keys []string
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return keys, iter.Err()
+	}
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	It("sorts items from multiple goroutines", func() {
+		subject := extsort.NewConcurrent(4, &extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+		})
+		defer subject.Close()
+
+		produce(subject, 8, 10_000)
+		Expect(subject.Size()).To(BeNumerically(">", 0))
+
+		keys, err := drain(subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(80_000))
+		for i, key := range keys {
+			Expect(key).To(Equal(fmt.Sprintf("%08d", i)))
+		}
+	})
+
+	It("de-duplicates across shards", func() {
+		subject := extsort.NewConcurrent(4, &extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			Dedupe:     bytes.Equal,
+		})
+		defer subject.Close()
+
+		produce(subject, 8, 1_000)
+		produce(subject, 8, 1_000)
+
+		keys, err := drain(subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(8_000))
+		for i, key := range keys {
+			Expect(key).To(Equal(fmt.Sprintf("%08d", i)))
+		}
+	})
+
+	It("supports limits", func() {
+		subject := extsort.NewConcurrent(4, &extsort.Options{
+			WorkDir: workDir,
+			Limit:   100,
+		})
+		defer subject.Close()
+
+		produce(subject, 8, 1_000)
+
+		keys, err := drain(subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(100))
+		Expect(keys[0]).To(Equal("00000000"))
+		Expect(keys[99]).To(Equal("00000099"))
+	})
+
+	It("shares a value log", func() {
+		subject := extsort.NewConcurrent(4, &extsort.Options{
+			BufferSize:     64 * 1024,
+			WorkDir:        workDir,
+			ValueThreshold: 10,
+		})
+		defer subject.Close()
+
+		produce(subject, 8, 1_000)
+		Expect(subject.PutReader([]byte("zzz"), bytes.NewReader(bytes.Repeat([]byte{'y'}, 20)))).To(Succeed())
+
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		var n int
+		for ; iter.Next(); n++ {
+			if n < 8_000 {
+				Expect(string(iter.Key())).To(Equal(fmt.Sprintf("%08d", n)))
+				Expect(iter.Value()).To(Equal(bytes.Repeat([]byte{'x'}, 20)))
+			} else {
+				Expect(string(iter.Key())).To(Equal("zzz"))
+				Expect(iter.Value()).To(Equal(bytes.Repeat([]byte{'y'}, 20)))
+			}
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		Expect(n).To(Equal(8_001))
+	})
+
+	It("divides the buffer between shards", func() {
+		subject := extsort.NewConcurrent(64, &extsort.Options{
+			BufferSize: 1024 * 1024,
+			WorkDir:    workDir,
+			KeepFiles:  true,
+		})
+		defer subject.Close()
+
+		// exceeds the BufferSize, but not 64 shards of the min buffer size
+		val := bytes.Repeat([]byte{'x'}, 100)
+		for i := 0; i < 20_000; i++ {
+			Expect(subject.Put([]byte(fmt.Sprintf("%08d", i)), val)).To(Succeed())
+		}
+		Expect(filepath.Glob(workDir + "/*")).NotTo(BeEmpty())
+
+		keys, err := drain(subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(HaveLen(20_000))
+		Expect(subject.Close()).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+	})
+
+	It("defaults to GOMAXPROCS shards", func() {
+		subject := extsort.NewConcurrent(0, &extsort.Options{WorkDir: workDir})
+		defer subject.Close()
+
+		Expect(subject.Append([]byte("foo"))).To(Succeed())
+		Expect(subject.Append([]byte("bar"))).To(Succeed())
+
+		keys, err := drain(subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(keys).To(Equal([]string{"bar", "foo"}))
+	})
+})
@@ -4,9 +4,19 @@ import "sync"
 
 var entryPool sync.Pool
 
+// recordKind tags entries and records of temporary runs.
+type recordKind uint8
+
+const (
+	recordValue   recordKind = iota
+	recordDeleted            // tombstone
+	recordPointer            // pointer to a value in the value log
+)
+
 type entry struct {
 	data   []byte
 	keyLen int
+	kind   recordKind
 }
 
 func fetchEntry(kn, vn int) *entry {
@@ -15,6 +25,7 @@ func fetchEntry(kn, vn int) *entry {
 		if e := v.(*entry); sz <= cap(e.data) {
 			e.data = e.data[:sz]
 			e.keyLen = kn
+			e.kind = recordValue
 			return e
 		}
 	}
@@ -36,6 +47,11 @@ func (e entry) ValLen() int {
 	return len(e.data) - e.keyLen
 }
 
+// Deleted returns true if the entry is a tombstone.
+func (e entry) Deleted() bool {
+	return e.kind == recordDeleted
+}
+
 func (e *entry) Release() {
 	entryPool.Put(e)
 }
@@ -1,18 +1,76 @@
 package extsort
 
-import "io"
+import (
+	"bytes"
+	"container/heap"
+	"errors"
+	"io"
+)
+
+// ErrDeleteLimit is returned when deleting keys in limit mode.
+var ErrDeleteLimit = errors.New("extsort: delete is not supported in limit mode")
 
 // Sorter is responsible for sorting.
 type Sorter struct {
-	opt *Options
-	buf *memBuffer
-	tw  *tempWriter
+	opt   *Options
+	buf   *memBuffer
+	tw    *tempWriter
+	sel   *selector
+	equal Equal
+
+	runs    []tempRun // runs written to tw
+	cutoff  []byte    // upper bound for keys in limit mode
+	pending int       // number of items written since last cutoff update
+
+	// append buffers to the last run while in order
+	mergeRuns        bool
+	open             bool // the last run is still open
+	lastKey, lastVal []byte
+
+	// background compaction of runs
+	compaction *compaction
+	ctw        *tempWriter
+
+	vlog *valueLog // large values, if separated
 }
 
 // New inits a sorter
 func New(opt *Options) *Sorter {
-	opt = opt.norm()
-	return &Sorter{opt: opt, buf: &memBuffer{compare: opt.Compare}}
+	// detect presorted input, unless a custom sort is used
+	detect := opt == nil || opt.Sort == nil
+	return newSorter(opt.norm(), detect)
+}
+
+// newSorter inits a sorter with normalized options. If detect is set,
+// sorting is skipped for presorted buffers.
+func newSorter(opt *Options, detect bool) *Sorter {
+	s := &Sorter{
+		opt:   opt,
+		equal: opt.keyEqual(),
+		vlog:  newValueLog(opt.WorkDir, opt.KeepFiles),
+	}
+	switch {
+	case opt.Limit > 0:
+		s.buf = newMemBuffer(opt, false)
+	case opt.ReplacementSelection:
+		s.buf = newMemBuffer(opt, false)
+		s.sel = &selector{heap: selectionHeap{memBuffer: s.buf}}
+	default:
+		s.buf = newMemBuffer(opt, detect)
+		s.mergeRuns = true
+	}
+	return s
+}
+
+// NewTopK inits a sorter that only retains the k smallest items.
+// It is a shortcut for setting Options.Limit.
+func NewTopK(k int, opt *Options) *Sorter {
+	var o Options
+	if opt != nil {
+		o = *opt
+	}
+	o.Limit = k
+	return New(&o)
 }
 
 // Append appends a data chunk to the sorter.
@@ -22,6 +80,88 @@ func (s *Sorter) Append(data []byte) error {
 
 // Put inserts a key value pair into the sorter.
 func (s *Sorter) Put(key, value []byte) error {
+	if s.opt.Limit > 0 {
+		return s.putLimited(key, value)
+	}
+	if s.opt.separate(value) {
+		ptr, err := s.vlog.Write(bytes.NewReader(value))
+		if err != nil {
+			return err
+		}
+		return s.put(recordPointer, key, ptr)
+	}
+	return s.put(recordValue, key, value)
+}
+
+// PutReader inserts a key and a value read from r into the sorter. The value
+// is written to the value log without being held in memory, unless key-value
+// separation is disabled (see Options.ValueThreshold).
+func (s *Sorter) PutReader(key []byte, r io.Reader) error {
+	if !s.opt.valueLog() {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return s.Put(key, value)
+	}
+
+	ptr, err := s.vlog.Write(r)
+	if err != nil {
+		return err
+	}
+	return s.put(recordPointer, key, ptr)
+}
+
+// Delete inserts a tombstone for key. It removes all items with an equal
+// key (as determined by Compare) that were added before, while items added
+// after are retained. Tombstones are never returned by iterators. Delete is
+// not supported in limit mode.
+func (s *Sorter) Delete(key []byte) error {
+	if s.opt.Limit > 0 {
+		return ErrDeleteLimit
+	}
+	return s.put(recordDeleted, key, nil)
+}
+
+func (s *Sorter) put(kind recordKind, key, value []byte) error {
+	if s.sel != nil {
+		return s.putSelect(kind, key, value)
+	}
+
+	if sz := s.buf.ByteSize(); sz > 0 && sz+len(key)+len(value) > s.opt.BufferSize {
+		if err := s.flush(); err != nil {
+			return err
+		}
+		if err := s.scheduleCompaction(); err != nil {
+			return err
+		}
+	}
+
+	s.buf.AppendKind(kind, key, value)
+	return nil
+}
+
+// putLimited maintains the buffer as a bounded max-heap and only spills
+// if the retained items exceed the buffer size.
+func (s *Sorter) putLimited(key, value []byte) error {
+	if s.cutoff != nil && s.opt.Compare(key, s.cutoff) > 0 {
+		return nil
+	}
+
+	h := limitHeap{memBuffer: s.buf}
+	if s.equal == nil && h.Len() >= s.opt.Limit {
+		top := h.ents[0]
+		c := s.opt.Compare(key, top.Key())
+		if c == 0 && s.opt.CompareValue != nil {
+			c = s.opt.CompareValue(value, top.Val())
+		}
+		// on ties, the most recently added item sorts first unless stable
+		if c > 0 || (c == 0 && s.opt.Stable) {
+			return nil
+		}
+		heap.Pop(h)
+	}
+
 	if sz := s.buf.ByteSize(); sz > 0 && sz+len(key)+len(value) > s.opt.BufferSize {
 		if err := s.flush(); err != nil {
 			return err
@@ -29,32 +169,300 @@ func (s *Sorter) Put(key, value []byte) error {
 	}
 
 	s.buf.Append(key, value)
+	heap.Fix(h, h.Len()-1)
+
+	if s.equal != nil && h.Len() >= 2*s.opt.Limit {
+		return s.compact()
+	}
 	return nil
 }
 
 // Sort applies the sort algorithm and returns an interator.
 func (s *Sorter) Sort() (*Iterator, error) {
-	if err := s.flush(); err != nil {
+	return s.sort(s.opt.BufferSize)
+}
+
+// Snapshot returns an iterator over all items added so far, without ending
+// ingestion. The sorter continues to accept items, which are not visible to
+// the returned iterator. The buffered items are copied, so a snapshot may
+// temporarily use up to twice the BufferSize. The iterator must be closed
+// before the sorter.
+func (s *Sorter) Snapshot() (*Iterator, error) {
+	// complete the run currently written, new items start a new one
+	if s.sel != nil && (s.sel.started || s.sel.cur != nil) {
+		if err := s.splitRun(); err != nil {
+			return nil, err
+		}
+	} else if err := s.closeRun(); err != nil {
+		return nil, err
+	}
+
+	sections, err := newTempReaders(s.runs, 0)
+	if err != nil {
 		return nil, err
 	}
+	sections = append(sections, s.copyBuffer())
+	return s.newIterator(sections)
+}
+
+// copyBuffer returns a sorted copy of the buffered items.
+func (s *Sorter) copyBuffer() *memSection {
+	buf := &memBuffer{
+		compare:      s.buf.compare,
+		compareValue: s.buf.compareValue,
+		stable:       s.buf.stable,
+		ents:         copyEntries(s.buf.ents),
+		deletes:      s.buf.deletes,
+	}
+	s.opt.Sort(buf)
+	buf.ApplyDeletes()
+	return &memSection{ents: buf.ents}
+}
+
+// sort returns an iterator, using up to budget bytes of memory for merging.
+func (s *Sorter) sort(budget int) (*Iterator, error) {
+	sections, err := s.sections(budget)
+	if err != nil {
+		return nil, err
+	}
+	return s.newIterator(sections)
+}
+
+// newIterator returns an iterator over sections, resolving values from the
+// value log.
+func (s *Sorter) newIterator(sections []section) (*Iterator, error) {
+	iter, err := newIterator(sections, s.opt)
+	if err != nil {
+		return nil, err
+	}
+	iter.vlog = s.vlog
+	return iter, nil
+}
+
+// sections completes the sort and returns the sorted sections to merge,
+// using up to budget bytes of memory for merging.
+func (s *Sorter) sections(budget int) ([]section, error) {
+	if ents, ok := s.sortBuffer(); ok {
+		return []section{&memSection{ents: ents}}, nil
+	}
+
+	if err := s.finish(); err != nil {
+		return nil, err
+	}
+	return s.runSections(budget)
+}
+
+// sortBuffer sorts the buffer and detaches the sorted entries, if the
+// output can be retained in memory. This is the case in limit mode, unless
+// items have been spilled already.
+func (s *Sorter) sortBuffer() ([]memBufferEntry, bool) {
+	if s.opt.Limit < 1 || s.tw != nil {
+		return nil, false
+	}
+
+	s.opt.Sort(s.buf)
+	return s.buf.Detach(), true
+}
+
+// finish writes all buffered items and completes all runs.
+func (s *Sorter) finish() error {
+	if err := s.flush(); err != nil {
+		return err
+	}
+	if err := s.closeRun(); err != nil {
+		return err
+	}
+	if err := s.stopCompaction(); err != nil {
+		return err
+	}
 
 	// free the write buffer
 	s.buf.Free()
+	return nil
+}
+
+// runSections opens the written runs, using up to budget bytes of memory
+// for merging.
+func (s *Sorter) runSections(budget int) ([]section, error) {
+	// merge key ranges concurrently, if enabled
+	if s.opt.MergeWorkers > 1 && len(s.runs) > 1 {
+		pm, err := newParallelMerge(s.runs, s.opt, budget)
+		if err != nil {
+			return nil, err
+		} else if pm != nil {
+			return []section{pm}, nil
+		}
+	}
 
-	// wrap in an iterator
-	return newIterator(s.tw.ReaderAt(), s.tw.offsets, s.opt)
+	// read ahead within the freed buffer budget
+	readAhead := readAheadBlocks(budget, len(s.runs))
+	return newTempReaders(s.runs, readAhead)
 }
 
-// Close stops the processing and removes temporary files.
-func (s *Sorter) Close() error {
+// SortPartitioned applies the sort algorithm and returns n iterators over
+// contiguous, non-overlapping key ranges in ascending order, such that
+// concatenating the partitions yields the output of Sort. Equal keys are
+// never split across partitions. Partitions are split at block boundaries
+// of the temporary output and are of roughly equal size, but may be empty.
+//
+// The iterators may be consumed concurrently and must all be closed. In
+// limit mode, the (at most Limit) results are retained in memory.
+func (s *Sorter) SortPartitioned(n int) ([]*Iterator, error) {
+	if n < 1 {
+		n = 1
+	}
+	if s.opt.Limit > 0 {
+		return s.sortPartitionedLimited(n)
+	}
+
+	if err := s.finish(); err != nil {
+		return nil, err
+	}
+
+	runs, err := readRunIndexes(s.runs)
+	if err != nil {
+		return nil, err
+	}
+
+	iters := make([]*Iterator, 0, n)
+	for _, kr := range keyRanges(pickSplitters(runs, s.opt.Compare, n)) {
+		iter, err := s.newIterator(newRangeSections(s.opt.Compression, runs, s.opt.Compare, kr))
+		if err != nil {
+			closeIterators(iters)
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	for len(iters) < n {
+		iter, err := s.newIterator(nil)
+		if err != nil {
+			closeIterators(iters)
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	return iters, nil
+}
+
+// sortPartitionedLimited retains the results in memory and splits them
+// into n partitions of equal size.
+func (s *Sorter) sortPartitionedLimited(n int) ([]*Iterator, error) {
+	iter, err := s.Sort()
+	if err != nil {
+		return nil, err
+	}
+
+	var ents []memBufferEntry
+	for iter.Next() {
+		// take ownership of the current entry
+		ents = append(ents, memBufferEntry{len(ents), iter.ent})
+		iter.ent = nil
+	}
+	err = iter.Err()
+	if e := iter.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = (&memSection{ents: ents}).Close()
+		return nil, err
+	}
+
+	iters := make([]*Iterator, 0, n)
+	for p, start := 1, 0; p <= n; p++ {
+		end := p * len(ents) / n
+		for end > start && end < len(ents) && s.opt.Compare(ents[end-1].Key(), ents[end].Key()) == 0 {
+			end++
+		}
+		if end < start {
+			end = start
+		}
+
+		iter, err := s.newIterator([]section{&memSection{ents: ents[start:end]}})
+		if err != nil {
+			closeIterators(iters)
+			_ = (&memSection{ents: ents[end:]}).Close()
+			return nil, err
+		}
+		iters = append(iters, iter)
+		start = end
+	}
+	return iters, nil
+}
+
+// closeIterators closes iters, ignoring errors.
+func closeIterators(iters []*Iterator) {
+	for _, iter := range iters {
+		_ = iter.Close()
+	}
+}
+
+// Reset discards all items, so the sorter can be reused. Temporary files
+// are truncated and the buffer capacity is retained. All iterators must be
+// closed before.
+func (s *Sorter) Reset() error {
+	s.discardCompaction()
+	if s.ctw != nil {
+		if err := s.ctw.Reset(); err != nil {
+			return err
+		}
+	}
 	if s.tw != nil {
-		return s.tw.Close()
+		if err := s.tw.Reset(); err != nil {
+			return err
+		}
+	}
+	if err := s.vlog.Reset(); err != nil {
+		return err
+	}
+
+	s.buf.Reset()
+	s.buf.Realloc()
+	s.runs = s.runs[:0]
+	s.cutoff = nil
+	s.pending = 0
+	s.open = false
+	s.lastKey = s.lastKey[:0]
+	s.lastVal = s.lastVal[:0]
+
+	if sel := s.sel; sel != nil {
+		if sel.cur != nil {
+			sel.cur.Release()
+		}
+		*sel = selector{
+			heap:    selectionHeap{memBuffer: s.buf, runs: sel.heap.runs[:0]},
+			lastKey: sel.lastKey[:0],
+			lastVal: sel.lastVal[:0],
+		}
 	}
 	return nil
 }
 
-// Size returns the buffered and written size.
+// Close stops the processing and removes temporary files.
+func (s *Sorter) Close() (err error) {
+	s.discardCompaction()
+	if s.ctw != nil {
+		err = s.ctw.Close()
+		s.ctw = nil
+	}
+	if s.tw != nil {
+		if e := s.tw.Close(); e != nil {
+			err = e
+		}
+	}
+	if e := s.vlog.Close(); e != nil {
+		err = e
+	}
+	return
+}
+
+// Size returns the buffered and written size, including values written to
+// the value log.
 func (s *Sorter) Size() int64 {
+	return s.size() + s.vlog.Size()
+}
+
+// size returns the buffered and written size, excluding the value log.
+func (s *Sorter) size() int64 {
 	sum := int64(s.buf.ByteSize())
 	if s.tw == nil {
 		return sum
@@ -63,61 +471,266 @@ func (s *Sorter) Size() int64 {
 }
 
 func (s *Sorter) flush() error {
-	if s.tw == nil {
-		tw, err := newTempWriter(s.opt.WorkDir, s.opt.Compression, s.opt.KeepFiles)
-		if err != nil {
+	if s.sel != nil {
+		return s.flushSelect()
+	}
+	if err := s.openTemp(); err != nil {
+		return err
+	}
+
+	// skip sorting presorted input
+	switch {
+	case s.buf.ascending:
+	case s.buf.descending:
+		s.buf.Reverse()
+	default:
+		s.opt.Sort(s.buf)
+	}
+	s.buf.ApplyDeletes()
+
+	// start a new run unless the buffer continues the open one
+	if s.open && !s.continuesRun() {
+		if err := s.closeRun(); err != nil {
 			return err
 		}
-		s.tw = tw
 	}
 
-	s.opt.Sort(s.buf)
+	// tombstones only need to be written if they shadow older runs
+	keepDeleted := len(s.runs) != 0
 
-	var lastKey []byte // store last for de-duplication
+	var lastKey, lastVal []byte
+	written, err := s.reduce(func(kind recordKind, key, val []byte) error {
+		if kind == recordDeleted && !keepDeleted {
+			return nil
+		}
+		lastKey, lastVal = key, val
+		return s.tw.EncodeKind(kind, key, val)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.open = true
+	if !s.mergeRuns {
+		if err := s.closeRun(); err != nil {
+			return err
+		}
+	} else if written != 0 {
+		s.lastKey = append(s.lastKey[:0], lastKey...)
+		s.lastVal = append(s.lastVal[:0], lastVal...)
+	}
+	s.buf.Reset()
+
+	if s.opt.Limit > 0 {
+		if s.pending += written; s.pending >= s.opt.Limit {
+			s.pending = 0
+			return s.updateCutoff()
+		}
+	}
+	return nil
+}
+
+// continuesRun returns true if the sorted buffer can be appended to the
+// open run.
+func (s *Sorter) continuesRun() bool {
+	if len(s.buf.ents) == 0 {
+		return true
+	}
+
+	first := s.buf.ents[0]
+	if s.equal != nil && s.equal(first.Key(), s.lastKey) {
+		return false
+	}
+	if first.Deleted() && s.opt.Compare(first.Key(), s.lastKey) == 0 {
+		return false // tombstones must not share a run with shadowed items
+	}
+	return s.opt.follows(first.Key(), first.Val(), s.lastKey, s.lastVal)
+}
+
+// closeRun completes the open run.
+func (s *Sorter) closeRun() error {
+	if !s.open {
+		return nil
+	}
+
+	run, err := s.tw.Flush()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.open = false
+	return nil
+}
+
+// openTemp creates the temporary file, if not yet created.
+func (s *Sorter) openTemp() error {
+	if s.tw != nil {
+		return nil
+	}
+
+	tw, err := newTempWriter(s.opt.WorkDir, s.opt.Compression, s.opt.KeepFiles)
+	if err != nil {
+		return err
+	}
+	s.tw = tw
+	return nil
+}
+
+// updateCutoff merges the written runs to find the current K-th item.
+// No items after it can be part of the result.
+func (s *Sorter) updateCutoff() error {
+	sections, err := newTempReaders(s.runs, 0)
+	if err != nil {
+		return err
+	}
+	iter, err := newIterator(sections, s.opt)
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.Next() {
+		if iter.count == s.opt.Limit {
+			s.lowerCutoff(iter.Key())
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return iter.Close()
+}
+
+// reduce calls fn for each item of the sorted buffer, applying
+// de-duplication and combination. It stops after Limit items and returns
+// the number of processed items.
+func (s *Sorter) reduce(fn func(kind recordKind, key, val []byte) error) (int, error) {
+	var cur *entry
+	var val []byte
+	var n int
 	for _, ent := range s.buf.ents {
-		if s.opt.Dedupe != nil {
-			key := ent.Key()
-			if lastKey != nil && s.opt.Dedupe(key, lastKey) {
+		if ent.Deleted() {
+			if cur != nil {
+				if err := fn(cur.kind, cur.Key(), val); err != nil {
+					return n, err
+				}
+				n++
+				cur, val = nil, nil
+			}
+			if err := fn(recordDeleted, ent.Key(), nil); err != nil {
+				return n, err
+			}
+			continue
+		}
+
+		if cur != nil {
+			if s.equal != nil && s.equal(ent.Key(), cur.Key()) {
+				switch {
+				case s.opt.Combine != nil:
+					val = s.opt.combineSorted(cur.Key(), val, ent.Val())
+				case s.opt.DedupePolicy == DedupeError:
+					return n, &DuplicateKeyError{Key: append([]byte(nil), cur.Key()...)}
+				case s.opt.keepTail():
+					cur, val = ent.entry, ent.Val()
+				}
 				continue
 			}
-			lastKey = key
+
+			if err := fn(cur.kind, cur.Key(), val); err != nil {
+				return n, err
+			}
+			if n++; n == s.opt.Limit {
+				return n, nil
+			}
 		}
+		cur, val = ent.entry, ent.Val()
+	}
 
-		if err := s.tw.Encode(ent.entry); err != nil {
-			return err
+	if cur != nil {
+		if err := fn(cur.kind, cur.Key(), val); err != nil {
+			return n, err
 		}
+		n++
+	}
+	return n, nil
+}
+
+// compact sorts, de-duplicates and combines the buffer, retaining no more
+// than Limit items.
+func (s *Sorter) compact() error {
+	s.opt.Sort(s.buf)
+
+	buf := &memBuffer{
+		compare:      s.buf.compare,
+		compareValue: s.buf.compareValue,
+		stable:       s.buf.stable,
+		ents:         make([]memBufferEntry, 0, s.opt.Limit),
 	}
-	if err := s.tw.Flush(); err != nil {
+	kept, err := s.reduce(func(_ recordKind, key, val []byte) error {
+		buf.Append(key, val)
+		return nil
+	})
+	if err != nil {
+		buf.Free()
 		return err
 	}
+	if kept == s.opt.Limit {
+		s.lowerCutoff(buf.ents[kept-1].Key())
+	}
 
-	s.buf.Reset()
+	s.buf.Free()
+	s.buf = buf
+	heap.Init(limitHeap{memBuffer: s.buf})
 	return nil
 }
 
+func (s *Sorter) lowerCutoff(key []byte) {
+	if s.cutoff == nil || s.opt.Compare(key, s.cutoff) < 0 {
+		s.cutoff = append(s.cutoff[:0], key...)
+	}
+}
+
 // --------------------------------------------------------------------
 
+// section is a sorted sequence of entries.
+type section interface {
+	// ReadNext returns the next entry or nil when exhausted.
+	ReadNext() (*entry, error)
+	// Close closes the section.
+	Close() error
+}
+
 // Iterator instances are used to iterate over sorted output.
 type Iterator struct {
-	tr   *tempReader
-	heap *minHeap
-
-	ent     *entry
-	lastKey []byte
-	dedupe  Equal
-	err     error
+	sections []section
+	heap     *minHeap
+
+	opt   *Options
+	ent   *entry
+	equal Equal
+	count int
+	err   error
+
+	// most recent tombstone, shadowing equal keys of older sections
+	keepDeleted bool // emit tombstones
+	tomb        []byte
+	tombSec     int
+	shadow      bool
+
+	vlog *valueLog
+	val  []byte // value read from vlog
+	read bool   // val is current
 }
 
-func newIterator(ra io.ReaderAt, offsets []int64, opt *Options) (*Iterator, error) {
-	tr, err := newTempReader(ra, offsets, opt.BufferSize, opt.Compression)
-	if err != nil {
-		return nil, err
+func newIterator(sections []section, opt *Options) (*Iterator, error) {
+	iter := &Iterator{
+		sections: sections,
+		heap:     &minHeap{compare: opt.Compare, compareValue: opt.CompareValue, stable: opt.Stable},
+		opt:      opt,
+		equal:    opt.keyEqual(),
 	}
-
-	iter := &Iterator{tr: tr, heap: &minHeap{compare: opt.Compare}, dedupe: opt.Dedupe}
-	for i := 0; i < tr.NumSections(); i++ {
+	for i := range sections {
 		if err := iter.fillHeap(i); err != nil {
-			_ = tr.Close()
+			_ = iter.Close()
 			return nil, err
 		}
 	}
@@ -126,40 +739,123 @@ func newIterator(ra io.ReaderAt, offsets []int64, opt *Options) (*Iterator, erro
 
 // Next advances the iterator to the next item and returns true if successful.
 func (i *Iterator) Next() bool {
-	for i.next() {
-		if i.dedupe != nil {
+	if i.opt.Limit > 0 && i.count == i.opt.Limit {
+		return false
+	}
+	if !i.next() {
+		return false
+	}
+	if i.equal != nil && !i.ent.Deleted() && !i.reduceNext() {
+		return false
+	}
+	i.count++
+	return true
+}
+
+// reduceNext de-duplicates or combines the current entry with all pending
+// entries with equal keys.
+func (i *Iterator) reduceNext() bool {
+	for i.heap.Len() != 0 {
+		if top := i.heap.items[0]; !i.equal(top.Key(), i.ent.Key()) {
+			break
+		}
+
+		section, ent := i.heap.PopEntry()
+		if err := i.fillHeap(section); err != nil {
+			ent.Release()
+			i.err = err
+			return false
+		}
+		if i.shadowed(section, ent) {
+			ent.Release()
+			continue
+		}
+
+		switch {
+		case i.opt.Combine != nil:
 			key := i.ent.Key()
-			if i.lastKey != nil && i.dedupe(key, i.lastKey) {
+			val := i.opt.combineSorted(key, i.ent.Val(), ent.Val())
+			merged := fetchEntry(len(key), len(val))
+			n := copy(merged.data, key)
+			copy(merged.data[n:], val)
+
+			ent.Release()
+			i.ent.Release()
+			i.ent = merged
+		case i.opt.DedupePolicy == DedupeError:
+			i.err = &DuplicateKeyError{Key: append([]byte(nil), ent.Key()...)}
+			ent.Release()
+			return false
+		case i.opt.keepTail():
+			i.ent.Release()
+			i.ent = ent
+		default:
+			ent.Release()
+		}
+	}
+	return true
+}
+
+func (i *Iterator) next() bool {
+	for {
+		if i.err != nil {
+			return false
+		}
+		if i.heap.Len() == 0 {
+			return false
+		}
+
+		section, ent := i.heap.PopEntry()
+		if err := i.fillHeap(section); err != nil {
+			ent.Release()
+			i.err = err
+			return false
+		}
+		if i.shadowed(section, ent) {
+			ent.Release()
+			continue
+		}
+
+		if ent.Deleted() {
+			i.tomb = append(i.tomb[:0], ent.Key()...)
+			i.tombSec = section
+			i.shadow = true
+
+			if !i.keepDeleted {
+				ent.Release()
 				continue
 			}
-			i.lastKey = append(i.lastKey[:0], key...)
+		}
+
+		prev := i.ent
+		i.ent = ent
+		i.read = false
+		if prev != nil {
+			prev.Release()
 		}
 		return true
 	}
-	return false
 }
 
-func (i *Iterator) next() bool {
-	if i.err != nil {
+// shadowed returns true if ent has an equal key as the most recent tombstone
+// and belongs to an older section. Tombstones sort first among equal keys,
+// so subsequent tombstones only update the shadowed sections.
+func (i *Iterator) shadowed(section int, ent *entry) bool {
+	if !i.shadow {
 		return false
 	}
-	if i.heap.Len() == 0 {
-		return false
-	}
-
-	section, ent := i.heap.PopEntry()
-	if err := i.fillHeap(section); err != nil {
-		ent.Release()
-		i.err = err
+	if i.opt.Compare(ent.Key(), i.tomb) != 0 {
+		i.shadow = false
 		return false
 	}
 
-	prev := i.ent
-	i.ent = ent
-	if prev != nil {
-		prev.Release()
+	if ent.Deleted() {
+		if section > i.tombSec {
+			i.tombSec = section
+		}
+		return true
 	}
-	return true
+	return section < i.tombSec
 }
 
 // Key returns the key at the current cursor position.
@@ -167,9 +863,38 @@ func (i *Iterator) Key() []byte {
 	return i.ent.Key()
 }
 
-// Value returns the value at the current cursor position.
+// Value returns the value at the current cursor position. Separated values
+// are read from the value log on demand. If reading fails, nil is returned
+// and the error is available via Err.
 func (i *Iterator) Value() []byte {
-	return i.ent.Val()
+	if i.ent.kind != recordPointer {
+		return i.ent.Val()
+	}
+	if !i.read {
+		val, err := i.vlog.ReadValue(i.val, i.ent.Val())
+		if err != nil {
+			i.err = err
+			return nil
+		}
+		i.val, i.read = val, true
+	}
+	return i.val
+}
+
+// ValueReader returns a reader for the value at the current cursor
+// position. Separated values are streamed from the value log. The reader
+// is only valid until the iterator is closed.
+func (i *Iterator) ValueReader() io.Reader {
+	if i.ent.kind != recordPointer {
+		return bytes.NewReader(i.ent.Val())
+	}
+
+	r, err := i.vlog.Reader(i.ent.Val())
+	if err != nil {
+		i.err = err
+		return bytes.NewReader(nil)
+	}
+	return r
 }
 
 // Data returns the data at the current cursor position (alias for Key).
@@ -183,17 +908,28 @@ func (i *Iterator) Err() error {
 }
 
 // Close closes the iterator.
-func (i *Iterator) Close() error {
+func (i *Iterator) Close() (err error) {
 	if i.ent != nil {
 		i.ent.Release()
 		i.ent = nil
 	}
+	for i.heap.Len() != 0 {
+		_, ent := i.heap.PopEntry()
+		ent.Release()
+	}
 
-	return i.tr.Close()
+	for _, sec := range i.sections {
+		if e := sec.Close(); e != nil {
+			err = e
+		}
+	}
+	i.sections = nil
+	i.val, i.read = nil, false
+	return
 }
 
 func (i *Iterator) fillHeap(section int) error {
-	ent, err := i.tr.ReadNext(section)
+	ent, err := i.sections[section].ReadNext()
 	if err != nil {
 		return err
 	}
@@ -4,6 +4,8 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -108,6 +110,163 @@ var _ = Describe("Sorter", func() {
 		}))
 	})
 
+	Context("stable", func() {
+		var stable *extsort.Sorter
+
+		BeforeEach(func() {
+			stable = extsort.New(&extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+				Stable:     true,
+			})
+		})
+
+		AfterEach(func() {
+			Expect(stable.Close()).To(Succeed())
+		})
+
+		It("preserves insertion order", func() {
+			Expect(stable.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(stable.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(stable.Put([]byte("baz"), []byte("v3"))).To(Succeed())
+			Expect(stable.Put([]byte("foo"), []byte("v4"))).To(Succeed())
+			Expect(stable.Put([]byte("bar"), []byte("v5"))).To(Succeed())
+			Expect(drain(stable)).To(Equal([][2]string{
+				{"bar", "v2"},
+				{"bar", "v5"},
+				{"baz", "v3"},
+				{"foo", "v1"},
+				{"foo", "v4"},
+			}))
+		})
+
+		It("preserves insertion order across runs", func() {
+			for i := 0; i < 50_000; i++ {
+				key := fmt.Sprintf("k%d", i%3)
+				Expect(stable.Put([]byte(key), []byte(fmt.Sprintf("%05d", i)))).To(Succeed())
+			}
+
+			pairs, err := drain(stable)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pairs).To(HaveLen(50_000))
+			Expect(sort.SliceIsSorted(pairs, func(i, j int) bool {
+				if pairs[i][0] != pairs[j][0] {
+					return pairs[i][0] < pairs[j][0]
+				}
+				return pairs[i][1] < pairs[j][1]
+			})).To(BeTrue())
+		})
+
+		It("is independent of de-duplication policy", func() {
+			for _, policy := range []extsort.DedupePolicy{extsort.DedupeKeepFirst, extsort.DedupeKeepLast} {
+				deduped := extsort.New(&extsort.Options{
+					BufferSize:   64 * 1024,
+					Dedupe:       bytes.Equal,
+					DedupePolicy: policy,
+					WorkDir:      workDir,
+					Stable:       true,
+				})
+				for i := 0; i < 50_000; i++ {
+					val := []byte(fmt.Sprintf("x%d", i))
+					Expect(deduped.Put([]byte("foo"), val)).To(Succeed())
+					Expect(deduped.Put([]byte("bar"), val)).To(Succeed())
+				}
+
+				exp := "x0"
+				if policy == extsort.DedupeKeepLast {
+					exp = "x49999"
+				}
+				Expect(drain(deduped)).To(Equal([][2]string{{"bar", exp}, {"foo", exp}}))
+				Expect(deduped.Close()).To(Succeed())
+			}
+		})
+
+		It("retains first items on ties when limited", func() {
+			topk := extsort.NewTopK(2, &extsort.Options{WorkDir: workDir, Stable: true})
+			defer topk.Close()
+
+			Expect(topk.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v3"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v4"))).To(Succeed())
+			Expect(drain(topk)).To(Equal([][2]string{
+				{"bar", "v2"},
+				{"bar", "v3"},
+			}))
+		})
+	})
+
+	Context("secondary sort", func() {
+		It("orders equal keys by value", func() {
+			secondary := extsort.New(&extsort.Options{
+				BufferSize:   64 * 1024,
+				WorkDir:      workDir,
+				CompareValue: bytes.Compare,
+			})
+			defer secondary.Close()
+
+			rnd := rand.New(rand.NewSource(33))
+			for i := 0; i < 50_000; i++ {
+				key := fmt.Sprintf("k%d", rnd.Intn(5))
+				val := fmt.Sprintf("%05d", rnd.Intn(100_000))
+				Expect(secondary.Put([]byte(key), []byte(val))).To(Succeed())
+			}
+
+			pairs, err := drain(secondary)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pairs).To(HaveLen(50_000))
+			Expect(sort.SliceIsSorted(pairs, func(i, j int) bool {
+				if pairs[i][0] != pairs[j][0] {
+					return pairs[i][0] < pairs[j][0]
+				}
+				return pairs[i][1] < pairs[j][1]
+			})).To(BeTrue())
+		})
+
+		It("is respected by de-duplication", func() {
+			for _, policy := range []extsort.DedupePolicy{extsort.DedupeKeepFirst, extsort.DedupeKeepLast} {
+				deduped := extsort.New(&extsort.Options{
+					BufferSize:   64 * 1024,
+					WorkDir:      workDir,
+					CompareValue: bytes.Compare,
+					Dedupe:       bytes.Equal,
+					DedupePolicy: policy,
+				})
+				for i := 0; i < 50_000; i++ {
+					val := []byte(fmt.Sprintf("%05d", (i*7919)%50_000))
+					Expect(deduped.Put([]byte("foo"), val)).To(Succeed())
+					Expect(deduped.Put([]byte("bar"), val)).To(Succeed())
+				}
+
+				exp := "00000"
+				if policy == extsort.DedupeKeepLast {
+					exp = "49999"
+				}
+				Expect(drain(deduped)).To(Equal([][2]string{{"bar", exp}, {"foo", exp}}))
+				Expect(deduped.Close()).To(Succeed())
+			}
+		})
+
+		It("supports limits", func() {
+			topk := extsort.NewTopK(3, &extsort.Options{
+				WorkDir:      workDir,
+				CompareValue: bytes.Compare,
+			})
+			defer topk.Close()
+
+			Expect(topk.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v5"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v3"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v4"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(drain(topk)).To(Equal([][2]string{
+				{"bar", "v2"},
+				{"bar", "v3"},
+				{"bar", "v4"},
+			}))
+		})
+	})
+
 	It("appends/sorts data", func() {
 		Expect(subject.Append([]byte("foo"))).To(Succeed())
 		Expect(subject.Append([]byte("bar"))).To(Succeed())
@@ -149,6 +308,78 @@ var _ = Describe("Sorter", func() {
 		}))
 	})
 
+	It("can de-duplicate keeping first", func() {
+		deduped := extsort.New(&extsort.Options{
+			BufferSize:   64 * 1024,
+			Dedupe:       bytes.Equal,
+			DedupePolicy: extsort.DedupeKeepFirst,
+			WorkDir:      workDir,
+		})
+		defer deduped.Close()
+
+		for i := 0; i < 100_000; i++ {
+			val := []byte(fmt.Sprintf("x%d", i))
+			Expect(deduped.Put([]byte("foo"), val)).To(Succeed())
+			Expect(deduped.Put([]byte("baz"), val)).To(Succeed())
+		}
+		Expect(deduped.Put([]byte("bar"), []byte("v1"))).To(Succeed())
+		Expect(deduped.Put([]byte("dau"), []byte("v2"))).To(Succeed())
+		Expect(drain(deduped)).To(Equal([][2]string{
+			{"bar", "v1"},
+			{"baz", "x0"},
+			{"dau", "v2"},
+			{"foo", "x0"},
+		}))
+	})
+
+	Context("fails on duplicates", func() {
+		var strict *extsort.Sorter
+
+		BeforeEach(func() {
+			strict = extsort.New(&extsort.Options{
+				BufferSize:   64 * 1024,
+				Dedupe:       bytes.Equal,
+				DedupePolicy: extsort.DedupeError,
+				WorkDir:      workDir,
+			})
+		})
+
+		AfterEach(func() {
+			Expect(strict.Close()).To(Succeed())
+		})
+
+		It("within a run", func() {
+			Expect(strict.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(strict.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(strict.Put([]byte("foo"), []byte("v3"))).To(Succeed())
+
+			_, err := strict.Sort()
+			Expect(err).To(MatchError(extsort.ErrDuplicateKey))
+			Expect(err).To(MatchError(`extsort: duplicate key "foo"`))
+
+			var dke *extsort.DuplicateKeyError
+			Expect(errors.As(err, &dke)).To(BeTrue())
+			Expect(dke.Key).To(Equal([]byte("foo")))
+		})
+
+		It("across runs", func() {
+			for i := 0; i < 20_000; i++ {
+				Expect(strict.Append([]byte(fmt.Sprintf("k%05d", i)))).To(Succeed())
+			}
+			Expect(strict.Append([]byte("k00033"))).To(Succeed())
+
+			_, err := drain(strict)
+			Expect(err).To(MatchError(`extsort: duplicate key "k00033"`))
+		})
+
+		It("passes on unique keys", func() {
+			for i := 0; i < 10_000; i++ {
+				Expect(strict.Append([]byte(fmt.Sprintf("k%05d", i)))).To(Succeed())
+			}
+			Expect(keys(strict)).To(HaveLen(10_000))
+		})
+	})
+
 	It("supports custom sorting", func() {
 		reverse := extsort.New(&extsort.Options{
 			BufferSize: 1024 * 1024,
@@ -203,8 +434,952 @@ var _ = Describe("Sorter", func() {
 			Expect(drain(compressed)).To(HaveLen(50))
 			Expect(fileSize()).To(BeNumerically("~", expSize, 100))
 		}
-		It("gzip compresses", func() { test(extsort.CompressionGzip, 400) })
-		It("snappy compresses", func() { test(extsort.CompressionSnappy, 10400) })
+		It("gzip compresses", func() { test(extsort.CompressionGzip, 1900) })
+		It("snappy compresses", func() { test(extsort.CompressionSnappy, 10750) })
+	})
+
+	Context("limits output", func() {
+		randKeys := func(n int) []string {
+			rnd := rand.New(rand.NewSource(33))
+			keys := make([]string, 0, n)
+			for i := 0; i < n; i++ {
+				keys = append(keys, fmt.Sprintf("%08d", rnd.Intn(n)))
+			}
+			return keys
+		}
+
+		smallest := func(keys []string, k int, uniq bool) []string {
+			sorted := append([]string(nil), keys...)
+			sort.Strings(sorted)
+			res := make([]string, 0, k)
+			for _, key := range sorted {
+				if len(res) == k {
+					break
+				}
+				if uniq && len(res) != 0 && res[len(res)-1] == key {
+					continue
+				}
+				res = append(res, key)
+			}
+			return res
+		}
+
+		It("retains top-K in memory", func() {
+			topk := extsort.NewTopK(100, &extsort.Options{
+				WorkDir:   workDir,
+				KeepFiles: true,
+			})
+			defer topk.Close()
+
+			input := randKeys(100_000)
+			for _, key := range input {
+				Expect(topk.Append([]byte(key))).To(Succeed())
+			}
+			Expect(topk.Size()).To(BeNumerically("==", 800))
+			Expect(keys(topk)).To(Equal(smallest(input, 100, false)))
+			Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+		})
+
+		It("retains most recent items on ties", func() {
+			topk := extsort.NewTopK(2, &extsort.Options{WorkDir: workDir})
+			defer topk.Close()
+
+			Expect(topk.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v3"))).To(Succeed())
+			Expect(topk.Put([]byte("bar"), []byte("v4"))).To(Succeed())
+			Expect(drain(topk)).To(Equal([][2]string{
+				{"bar", "v4"},
+				{"bar", "v3"},
+			}))
+		})
+
+		It("falls back to pruned external sort", func() {
+			topk := extsort.NewTopK(20_000, &extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+			})
+			defer topk.Close()
+
+			input := randKeys(100_000)
+			for _, key := range input {
+				Expect(topk.Put([]byte(key), []byte("value"))).To(Succeed())
+			}
+			Expect(topk.Size()).To(BeNumerically("<", 100_000*13))
+			Expect(keys(topk)).To(Equal(smallest(input, 20_000, false)))
+		})
+
+		It("supports de-duplication", func() {
+			input := randKeys(100_000)
+			for _, bufSize := range []int{64 * 1024, 1024 * 1024} {
+				topk := extsort.NewTopK(10_000, &extsort.Options{
+					BufferSize: bufSize,
+					Dedupe:     bytes.Equal,
+					WorkDir:    workDir,
+				})
+				for _, key := range input {
+					Expect(topk.Append([]byte(key))).To(Succeed())
+				}
+				Expect(keys(topk)).To(Equal(smallest(input, 10_000, true)))
+				Expect(topk.Close()).To(Succeed())
+			}
+		})
+	})
+
+	Context("combines values", func() {
+		u64 := func(n uint64) []byte {
+			b := make([]byte, 8)
+			binary.BigEndian.PutUint64(b, n)
+			return b
+		}
+		sum := func(_, a, b []byte) []byte {
+			return u64(binary.BigEndian.Uint64(a) + binary.BigEndian.Uint64(b))
+		}
+
+		It("counts words", func() {
+			counter := extsort.New(&extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+				Combine:    sum,
+			})
+			defer counter.Close()
+
+			one := u64(1)
+			for i := 0; i < 100_000; i++ {
+				Expect(counter.Put([]byte(fmt.Sprintf("w%d", i%7)), one)).To(Succeed())
+			}
+			Expect(counter.Size()).To(BeNumerically("<", 100_000))
+
+			iter, err := counter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+			defer iter.Close()
+
+			counts := make(map[string]uint64)
+			for iter.Next() {
+				counts[string(iter.Key())] = binary.BigEndian.Uint64(iter.Value())
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(counts).To(Equal(map[string]uint64{
+				"w0": 14286, "w1": 14286, "w2": 14286, "w3": 14286,
+				"w4": 14286, "w5": 14285, "w6": 14285,
+			}))
+		})
+
+		It("combines in insertion order", func() {
+			concat := extsort.New(&extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+				Combine: func(_, a, b []byte) []byte {
+					return append(append(append([]byte(nil), a...), ','), b...)
+				},
+			})
+			defer concat.Close()
+
+			Expect(concat.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(concat.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(concat.Put([]byte("foo"), []byte("v3"))).To(Succeed())
+			Expect(concat.Put([]byte("foo"), []byte("v4"))).To(Succeed())
+			Expect(concat.Put([]byte("baz"), []byte("v5"))).To(Succeed())
+			Expect(drain(concat)).To(Equal([][2]string{
+				{"bar", "v2"},
+				{"baz", "v5"},
+				{"foo", "v1,v3,v4"},
+			}))
+		})
+
+		It("supports limits", func() {
+			topk := extsort.NewTopK(3, &extsort.Options{
+				WorkDir: workDir,
+				Combine: sum,
+			})
+			defer topk.Close()
+
+			one := u64(1)
+			for i := 0; i < 1000; i++ {
+				Expect(topk.Put([]byte(fmt.Sprintf("w%d", i%7)), one)).To(Succeed())
+			}
+			Expect(drain(topk)).To(Equal([][2]string{
+				{"w0", string(u64(143))},
+				{"w1", string(u64(143))},
+				{"w2", string(u64(143))},
+			}))
+		})
+	})
+
+	Context("parallel merge", func() {
+		sortAll := func(opt extsort.Options) ([][2]string, error) {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i := 0; i < 50_000; i++ {
+				key := fmt.Sprintf("k%05d", (i*7919)%20_000)
+				if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7))); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		DescribeTable("merges like a single-threaded merge",
+			func(opt extsort.Options) {
+				expected, err := sortAll(opt)
+				Expect(err).NotTo(HaveOccurred())
+
+				opt.MergeWorkers = 4
+				Expect(sortAll(opt)).To(Equal(expected))
+			},
+			optionEntries("default", "stable", "secondary sort", "de-duplicated", "combined"),
+			Entry("limited", extsort.Options{Limit: 30_000}),
+			optionEntries("compressed"),
+		)
+
+		It("stops workers when closed early", func() {
+			sorter := extsort.New(&extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, MergeWorkers: 4})
+			defer sorter.Close()
+
+			for i := 0; i < 50_000; i++ {
+				Expect(sorter.Put([]byte(fmt.Sprintf("k%05d", i)), bytes.Repeat([]byte{'x'}, 100))).To(Succeed())
+			}
+
+			before := runtime.NumGoroutine()
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(iter.Next()).To(BeTrue())
+			Expect(string(iter.Key())).To(Equal("k00000"))
+			Expect(runtime.NumGoroutine()).To(BeNumerically(">", before))
+
+			Expect(iter.Close()).To(Succeed())
+			Expect(runtime.NumGoroutine()).To(Equal(before))
+		})
+	})
+
+	Context("presorted", func() {
+		sortAll := func(opt extsort.Options, input []string) ([][2]string, error) {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i, key := range input {
+				if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7))); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		// a custom sort func disables the detection of presorted input
+		sortRegular := func(opt extsort.Options, input []string) ([][2]string, error) {
+			opt.Sort = sort.Sort
+			return sortAll(opt, input)
+		}
+
+		inputs := map[string]func(i int) string{
+			"ascending":        func(i int) string { return fmt.Sprintf("k%05d", i) },
+			"descending":       func(i int) string { return fmt.Sprintf("k%05d", 50_000-i) },
+			"with duplicates":  func(i int) string { return fmt.Sprintf("k%05d", i/3) },
+			"in ordered parts": func(i int) string { return fmt.Sprintf("k%05d", i/4_000*4_000+(i*7919)%4_000) },
+		}
+
+		DescribeTable("sorts like a regular sort",
+			func(opt extsort.Options) {
+				for name, fn := range inputs {
+					input := make([]string, 0, 50_000)
+					for i := 0; i < 50_000; i++ {
+						input = append(input, fn(i))
+					}
+
+					expected, err := sortRegular(opt, input)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(sortAll(opt, input)).To(Equal(expected), name)
+				}
+			},
+			optionEntries("default", "stable", "secondary sort", "de-duplicated", "combined"),
+		)
+	})
+
+	Context("replacement selection", func() {
+		sortAll := func(opt extsort.Options, input []string) ([][2]string, error) {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i, key := range input {
+				if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7))); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		DescribeTable("sorts like a regular sort",
+			func(opt extsort.Options) {
+				input := make([]string, 0, 50_000)
+				for i := 0; i < 50_000; i++ {
+					input = append(input, fmt.Sprintf("k%05d", (i*7919)%20_000))
+				}
+
+				expected, err := sortAll(opt, input)
+				Expect(err).NotTo(HaveOccurred())
+
+				opt.ReplacementSelection = true
+				Expect(sortAll(opt, input)).To(Equal(expected))
+			},
+			optionEntries(
+				"default", "stable", "secondary sort", "de-duplicated", "de-duplicated, keep first",
+				"combined", "limited",
+			),
+		)
+
+		// countRuns adds input to a sorter and counts the runs written to
+		// the temporary file.
+		countRuns := func(opt extsort.Options, input []string) (int, error) {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+			opt.KeepFiles = true
+
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i, key := range input {
+				if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7))); err != nil {
+					return 0, err
+				}
+			}
+			iter, err := sorter.Sort()
+			if err != nil {
+				return 0, err
+			}
+			defer iter.Close()
+
+			files, err := filepath.Glob(workDir + "/*")
+			if err != nil {
+				return 0, err
+			} else if len(files) != 1 {
+				return 0, fmt.Errorf("expected one file: %v", files)
+			}
+			data, err := ioutil.ReadFile(files[0])
+			if err != nil {
+				return 0, err
+			}
+			// each run starts with a header and ends with a footer
+			return bytes.Count(data, []byte("XSRT")) / 2, nil
+		}
+
+		It("writes runs of twice the buffer size on random input", func() {
+			rnd := rand.New(rand.NewSource(33))
+			input := make([]string, 0, 300_000)
+			for i := 0; i < 300_000; i++ {
+				input = append(input, fmt.Sprintf("k%08d", rnd.Intn(100_000_000)))
+			}
+
+			plain, err := countRuns(extsort.Options{}, input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plain).To(BeNumerically(">=", 10))
+
+			runs, err := countRuns(extsort.Options{ReplacementSelection: true}, input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(runs).To(BeNumerically("~", plain/2, 2))
+		})
+
+		It("sorts nearly sorted input", func() {
+			input := make([]string, 0, 50_000)
+			for i := 0; i < 50_000; i++ {
+				input = append(input, fmt.Sprintf("k%05d", i+(i%10)*3))
+			}
+
+			pairs, err := sortAll(extsort.Options{ReplacementSelection: true}, input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pairs).To(HaveLen(50_000))
+			Expect(sort.SliceIsSorted(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })).To(BeTrue())
+
+			plain, err := countRuns(extsort.Options{}, input)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(plain).To(BeNumerically(">", 1))
+			Expect(countRuns(extsort.Options{ReplacementSelection: true}, input)).To(Equal(1))
+		})
+
+		It("fails on duplicates", func() {
+			input := []string{"foo", "bar", "foo"}
+			_, err := sortAll(extsort.Options{ReplacementSelection: true, Dedupe: bytes.Equal, DedupePolicy: extsort.DedupeError}, input)
+			Expect(err).To(MatchError(extsort.ErrDuplicateKey))
+		})
+	})
+
+	Context("snapshot", func() {
+		sortAll := func(opt extsort.Options, input []string) ([][2]string, error) {
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i, key := range input {
+				if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7))); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		sortPairs := func(opt extsort.Options, keys, values []string) ([][2]string, error) {
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i, key := range keys {
+				if err := sorter.Put([]byte(key), []byte(values[i])); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		readAll := func(iter *extsort.Iterator) ([][2]string, error) {
+			defer iter.Close()
+
+			var pairs [][2]string
+			for iter.Next() {
+				pairs = append(pairs, [2]string{string(iter.Key()), string(iter.Value())})
+			}
+			if err := iter.Err(); err != nil {
+				return nil, err
+			}
+			return pairs, iter.Close()
+		}
+
+		DescribeTable("iterates over items added so far",
+			func(opt extsort.Options) {
+				opt.BufferSize = 64 * 1024
+				opt.WorkDir = workDir
+
+				input := make([]string, 0, 50_000)
+				for i := 0; i < 50_000; i++ {
+					input = append(input, fmt.Sprintf("k%05d", (i*7919)%20_000))
+				}
+
+				sorter := extsort.New(&opt)
+				defer sorter.Close()
+
+				// add items in three steps, taking a snapshot after each
+				offset := 0
+				for _, n := range []int{12_345, 30_000, 50_000} {
+					for i := offset; i < n; i++ {
+						Expect(sorter.Put([]byte(input[i]), []byte(fmt.Sprintf("v%d", i%7)))).To(Succeed())
+					}
+					offset = n
+
+					iter, err := sorter.Snapshot()
+					Expect(err).NotTo(HaveOccurred())
+					expected, err := sortAll(opt, input[:n])
+					Expect(err).NotTo(HaveOccurred())
+					Expect(readAll(iter)).To(Equal(expected))
+				}
+
+				expected, err := sortAll(opt, input)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(drain(sorter)).To(Equal(expected))
+			},
+			optionEntries(
+				"default", "stable", "secondary sort", "de-duplicated", "de-duplicated, keep first",
+				"combined", "replacement selection", "compaction", "limited",
+			),
+		)
+
+		DescribeTable("retains the order of equal keys",
+			func(opt extsort.Options) {
+				opt.BufferSize = 16 * 1024
+				opt.WorkDir = workDir
+
+				// compare with a plain sort
+				plain := opt
+				plain.ReplacementSelection = false
+				plain.MaxRuns = 0
+
+				sorter := extsort.New(&opt)
+				defer sorter.Close()
+
+				var input, values []string
+				for i := 0; i < 20_000; i++ {
+					key, val := fmt.Sprintf("k%03d", (i*7919)%300), fmt.Sprintf("v%d", i)
+					Expect(sorter.Put([]byte(key), []byte(val))).To(Succeed())
+					input, values = append(input, key), append(values, val)
+
+					if i%1_999 == 0 {
+						iter, err := sorter.Snapshot()
+						Expect(err).NotTo(HaveOccurred())
+						expected, err := sortPairs(plain, input, values)
+						Expect(err).NotTo(HaveOccurred())
+						Expect(readAll(iter)).To(Equal(expected))
+					}
+				}
+
+				expected, err := sortPairs(plain, input, values)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(drain(sorter)).To(Equal(expected))
+			},
+			optionEntries(
+				"default", "stable", "de-duplicated", "de-duplicated, keep first", "combined",
+				"replacement selection", "replacement selection, stable", "compaction",
+			),
+			Entry("replacement selection, de-duplicated", extsort.Options{ReplacementSelection: true, Dedupe: bytes.Equal}),
+			Entry("replacement selection, combined", extsort.Options{ReplacementSelection: true, Combine: concatValues}),
+		)
+
+		It("supports buffered items only", func() {
+			sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+			defer sorter.Close()
+
+			Expect(sorter.Append([]byte("foo"))).To(Succeed())
+			Expect(sorter.Append([]byte("bar"))).To(Succeed())
+
+			iter, err := sorter.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(readAll(iter)).To(Equal([][2]string{{"bar", ""}, {"foo", ""}}))
+			Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+
+			Expect(sorter.Append([]byte("baz"))).To(Succeed())
+			Expect(drain(sorter)).To(Equal([][2]string{{"bar", ""}, {"baz", ""}, {"foo", ""}}))
+		})
+	})
+
+	Context("reset", func() {
+		DescribeTable("sorts multiple batches",
+			func(opt extsort.Options) {
+				opt.BufferSize = 64 * 1024
+				opt.WorkDir = workDir
+				opt.KeepFiles = true
+
+				sorter := extsort.New(&opt)
+				defer sorter.Close()
+
+				var files []string
+				for batch := 0; batch < 3; batch++ {
+					input := make([]string, 0, 30_000)
+					for i := 0; i < 30_000; i++ {
+						input = append(input, fmt.Sprintf("k%05d", (i*7919+batch)%20_000))
+					}
+
+					fresh := extsort.New(&opt)
+					for i, key := range input {
+						Expect(fresh.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7)))).To(Succeed())
+						Expect(sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7)))).To(Succeed())
+					}
+					expected, err := drain(fresh)
+					Expect(err).NotTo(HaveOccurred())
+					Expect(fresh.Close()).To(Succeed())
+
+					Expect(drain(sorter)).To(Equal(expected))
+					Expect(sorter.Reset()).To(Succeed())
+					Expect(sorter.Size()).To(BeZero())
+
+					current, err := filepath.Glob(workDir + "/*")
+					Expect(err).NotTo(HaveOccurred())
+					if files != nil {
+						Expect(current).To(Equal(files))
+					}
+					files = current
+				}
+			},
+			optionEntries(
+				"default", "de-duplicated", "replacement selection", "compaction", "limited",
+			),
+		)
+
+		It("discards buffered items", func() {
+			sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+			defer sorter.Close()
+
+			Expect(sorter.Append([]byte("foo"))).To(Succeed())
+			Expect(sorter.Reset()).To(Succeed())
+			Expect(sorter.Append([]byte("bar"))).To(Succeed())
+			Expect(drain(sorter)).To(Equal([][2]string{{"bar", ""}}))
+		})
+	})
+
+	Context("delete", func() {
+		type op struct {
+			key, val string
+			deleted  bool
+		}
+
+		// ops returns n operations, deleting every 7th key
+		ops := func(n int) []op {
+			ops := make([]op, 0, n)
+			for i := 0; i < n; i++ {
+				key := fmt.Sprintf("k%05d", (i*7919)%5_000)
+				ops = append(ops, op{key: key, val: fmt.Sprintf("v%d", i%7), deleted: i%7 == 3})
+			}
+			return ops
+		}
+
+		// survivors returns the items not followed by a tombstone
+		survivors := func(ops []op) []op {
+			lastDelete := make(map[string]int)
+			for i, o := range ops {
+				if o.deleted {
+					lastDelete[o.key] = i
+				}
+			}
+
+			var kept []op
+			for i, o := range ops {
+				if n, ok := lastDelete[o.key]; !o.deleted && (!ok || i > n) {
+					kept = append(kept, o)
+				}
+			}
+			return kept
+		}
+
+		apply := func(sorter *extsort.Sorter, ops []op) {
+			for _, o := range ops {
+				if o.deleted {
+					Expect(sorter.Delete([]byte(o.key))).To(Succeed())
+				} else {
+					Expect(sorter.Put([]byte(o.key), []byte(o.val))).To(Succeed())
+				}
+			}
+		}
+
+		DescribeTable("omits deleted items",
+			func(opt extsort.Options) {
+				opt.BufferSize = 64 * 1024
+				opt.WorkDir = workDir
+
+				all := ops(50_000)
+				reference := extsort.New(&opt)
+				defer reference.Close()
+				apply(reference, survivors(all))
+				expected, err := drain(reference)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(len(expected)).To(BeNumerically(">", 0))
+
+				sorter := extsort.New(&opt)
+				defer sorter.Close()
+				apply(sorter, all[:20_000])
+
+				snapshot, err := sorter.Snapshot()
+				Expect(err).NotTo(HaveOccurred())
+				defer snapshot.Close()
+
+				apply(sorter, all[20_000:])
+				Expect(drain(sorter)).To(Equal(expected))
+
+				// snapshots only include items added before
+				partial := extsort.New(&opt)
+				defer partial.Close()
+				apply(partial, survivors(all[:20_000]))
+				expected, err = drain(partial)
+				Expect(err).NotTo(HaveOccurred())
+
+				var pairs [][2]string
+				for snapshot.Next() {
+					pairs = append(pairs, [2]string{string(snapshot.Key()), string(snapshot.Value())})
+				}
+				Expect(snapshot.Err()).NotTo(HaveOccurred())
+				Expect(pairs).To(Equal(expected))
+			},
+			optionEntries(
+				"default", "stable", "secondary sort", "de-duplicated", "de-duplicated, keep first",
+				"combined", "replacement selection", "replacement selection, stable", "compaction",
+				"parallel merge",
+			),
+		)
+
+		It("omits deleted keys", func() {
+			sorter := extsort.New(&extsort.Options{Dedupe: bytes.Equal})
+			defer sorter.Close()
+
+			Expect(sorter.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(sorter.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+			Expect(sorter.Delete([]byte("foo"))).To(Succeed())
+			Expect(sorter.Put([]byte("baz"), []byte("v3"))).To(Succeed())
+			Expect(sorter.Delete([]byte("baz"))).To(Succeed())
+			Expect(sorter.Put([]byte("baz"), []byte("v4"))).To(Succeed())
+			Expect(sorter.Delete([]byte("qux"))).To(Succeed())
+			Expect(drain(sorter)).To(Equal([][2]string{{"bar", "v2"}, {"baz", "v4"}}))
+		})
+
+		It("is not supported in limit mode", func() {
+			sorter := extsort.NewTopK(3, nil)
+			defer sorter.Close()
+
+			Expect(sorter.Delete([]byte("foo"))).To(MatchError(extsort.ErrDeleteLimit))
+		})
+	})
+
+	Context("compaction", func() {
+		sortAll := func(opt extsort.Options, input []string) ([][2]string, error) {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i, key := range input {
+				if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7))); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		DescribeTable("sorts like a regular sort",
+			func(opt extsort.Options) {
+				input := make([]string, 0, 100_000)
+				for i := 0; i < 100_000; i++ {
+					input = append(input, fmt.Sprintf("k%05d", (i*7919)%40_000))
+				}
+
+				expected, err := sortAll(opt, input)
+				Expect(err).NotTo(HaveOccurred())
+
+				opt.MaxRuns = 2
+				Expect(sortAll(opt, input)).To(Equal(expected))
+			},
+			optionEntries(
+				"default", "stable", "secondary sort", "de-duplicated", "de-duplicated, keep first",
+				"combined", "replacement selection", "limited",
+			),
+		)
+
+		It("writes compacted runs to a separate file", func() {
+			sorter := extsort.New(&extsort.Options{
+				BufferSize: 64 * 1024,
+				WorkDir:    workDir,
+				KeepFiles:  true,
+				MaxRuns:    2,
+			})
+			defer sorter.Close()
+
+			val := bytes.Repeat([]byte{'x'}, 100)
+			for i := 0; i < 20_000; i++ {
+				Expect(sorter.Put([]byte(fmt.Sprintf("k%05d", (i*7919)%20_000)), val)).To(Succeed())
+			}
+			Expect(filepath.Glob(workDir + "/*")).To(HaveLen(2))
+
+			pairs, err := drain(sorter)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(pairs).To(HaveLen(20_000))
+			Expect(sort.SliceIsSorted(pairs, func(i, j int) bool { return pairs[i][0] < pairs[j][0] })).To(BeTrue())
+
+			Expect(sorter.Close()).To(Succeed())
+			Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+		})
+
+		It("fails on duplicates", func() {
+			input := make([]string, 0, 50_000)
+			for i := 0; i < 50_000; i++ {
+				input = append(input, fmt.Sprintf("k%05d", (i*7919)%40_000))
+			}
+			_, err := sortAll(extsort.Options{MaxRuns: 2, Dedupe: bytes.Equal, DedupePolicy: extsort.DedupeError}, input)
+			Expect(err).To(MatchError(extsort.ErrDuplicateKey))
+		})
+	})
+
+	Context("value log", func() {
+		value := func(i int) []byte {
+			if i%5 == 0 {
+				return bytes.Repeat([]byte{byte('a' + i%26)}, 1000+i%100)
+			}
+			return []byte(fmt.Sprintf("v%d", i))
+		}
+
+		sortAll := func(opt extsort.Options, n int) ([][2]string, error) {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+
+			sorter := extsort.New(&opt)
+			defer sorter.Close()
+
+			for i := 0; i < n; i++ {
+				if err := sorter.Put([]byte(fmt.Sprintf("k%05d", (i*7919)%20_000)), value(i)); err != nil {
+					return nil, err
+				}
+			}
+			return drain(sorter)
+		}
+
+		DescribeTable("sorts like a regular sort",
+			func(opt extsort.Options) {
+				expected, err := sortAll(opt, 50_000)
+				Expect(err).NotTo(HaveOccurred())
+
+				opt.ValueThreshold = 100
+				Expect(sortAll(opt, 50_000)).To(Equal(expected))
+			},
+			optionEntries(
+				"default", "stable", "de-duplicated", "parallel merge", "replacement selection",
+				"compaction", "secondary sort", "limited",
+			),
+		)
+
+		It("streams values from readers", func() {
+			sorter := extsort.New(&extsort.Options{
+				BufferSize:     64 * 1024,
+				WorkDir:        workDir,
+				KeepFiles:      true,
+				ValueThreshold: 1024,
+			})
+			defer sorter.Close()
+
+			for i := 0; i < 100; i++ {
+				val := bytes.Repeat([]byte{byte('a' + i%26)}, 256*1024)
+				Expect(sorter.PutReader([]byte(fmt.Sprintf("k%03d", 99-i)), bytes.NewReader(val))).To(Succeed())
+			}
+			Expect(sorter.Size()).To(BeNumerically("~", 100*256*1024, 64*1024))
+			Expect(filepath.Glob(workDir + "/*")).To(HaveLen(1))
+
+			iter, err := sorter.Sort()
+			Expect(err).NotTo(HaveOccurred())
+			defer iter.Close()
+
+			var n int
+			for ; iter.Next(); n++ {
+				Expect(string(iter.Key())).To(Equal(fmt.Sprintf("k%03d", n)))
+
+				data, err := ioutil.ReadAll(iter.ValueReader())
+				Expect(err).NotTo(HaveOccurred())
+				Expect(data).To(Equal(bytes.Repeat([]byte{byte('a' + (99-n)%26)}, 256*1024)))
+				Expect(iter.Value()).To(Equal(data))
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(n).To(Equal(100))
+			Expect(iter.Close()).To(Succeed())
+
+			Expect(sorter.Close()).To(Succeed())
+			Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+		})
+
+		It("reads values into memory if disabled", func() {
+			sorter := extsort.New(&extsort.Options{
+				WorkDir:   workDir,
+				KeepFiles: true,
+			})
+			defer sorter.Close()
+
+			Expect(sorter.PutReader([]byte("b"), bytes.NewReader([]byte("v2")))).To(Succeed())
+			Expect(sorter.PutReader([]byte("a"), bytes.NewReader([]byte("v1")))).To(Succeed())
+			Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+			Expect(drain(sorter)).To(Equal([][2]string{{"a", "v1"}, {"b", "v2"}}))
+		})
+
+		It("supports snapshots and deletes", func() {
+			sorter := extsort.New(&extsort.Options{
+				BufferSize:     16 * 1024,
+				WorkDir:        workDir,
+				ValueThreshold: 100,
+			})
+			defer sorter.Close()
+
+			for i := 0; i < 1000; i++ {
+				Expect(sorter.Put([]byte(fmt.Sprintf("k%03d", i)), value(i))).To(Succeed())
+			}
+			for i := 0; i < 1000; i += 2 {
+				Expect(sorter.Delete([]byte(fmt.Sprintf("k%03d", i)))).To(Succeed())
+			}
+
+			iter, err := sorter.Snapshot()
+			Expect(err).NotTo(HaveOccurred())
+			defer iter.Close()
+
+			var n int
+			for i := 1; iter.Next(); i += 2 {
+				Expect(string(iter.Key())).To(Equal(fmt.Sprintf("k%03d", i)))
+				Expect(iter.Value()).To(Equal(value(i)))
+				n++
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(n).To(Equal(500))
+		})
+	})
+
+	Context("partitioned", func() {
+		fill := func(opt extsort.Options) *extsort.Sorter {
+			opt.BufferSize = 64 * 1024
+			opt.WorkDir = workDir
+
+			sorter := extsort.New(&opt)
+			for i := 0; i < 50_000; i++ {
+				key := fmt.Sprintf("k%05d", (i*7919)%20_000)
+				Expect(sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i)))).To(Succeed())
+			}
+			return sorter
+		}
+
+		sortPartitioned := func(sorter *extsort.Sorter, n int) ([][][2]string, error) {
+			iters, err := sorter.SortPartitioned(n)
+			if err != nil {
+				return nil, err
+			}
+
+			parts := make([][][2]string, len(iters))
+			errs := make(chan error, len(iters))
+			for p := range iters {
+				go func(p int) {
+					iter := iters[p]
+					defer iter.Close()
+
+					for iter.Next() {
+						parts[p] = append(parts[p], [2]string{string(iter.Key()), string(iter.Value())})
+					}
+					if err := iter.Err(); err != nil {
+						errs <- err
+						return
+					}
+					errs <- iter.Close()
+				}(p)
+			}
+			for range iters {
+				if err := <-errs; err != nil {
+					return nil, err
+				}
+			}
+			return parts, nil
+		}
+
+		DescribeTable("splits output into ordered partitions",
+			func(opt extsort.Options, minSize int) {
+				sorter := fill(opt)
+				defer sorter.Close()
+				expected, err := drain(sorter)
+				Expect(err).NotTo(HaveOccurred())
+
+				sorter = fill(opt)
+				defer sorter.Close()
+				parts, err := sortPartitioned(sorter, 4)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(parts).To(HaveLen(4))
+
+				var actual [][2]string
+				for p, part := range parts {
+					Expect(len(part)).To(BeNumerically(">=", minSize))
+					if p > 0 {
+						Expect(part[0][0]).NotTo(Equal(actual[len(actual)-1][0]))
+					}
+					actual = append(actual, part...)
+				}
+				Expect(actual).To(Equal(expected))
+			},
+			Entry("default", extsort.Options{}, 7_500),
+			Entry("de-duplicated", extsort.Options{Dedupe: bytes.Equal}, 3_000),
+			Entry("limited", extsort.Options{Limit: 1_001}, 200),
+		)
+
+		It("returns empty partitions", func() {
+			sorter := extsort.New(&extsort.Options{WorkDir: workDir})
+			defer sorter.Close()
+			Expect(sorter.Put([]byte("foo"), []byte("v1"))).To(Succeed())
+			Expect(sorter.Put([]byte("bar"), []byte("v2"))).To(Succeed())
+
+			Expect(sortPartitioned(sorter, 3)).To(Equal([][][2]string{
+				{{"bar", "v2"}, {"foo", "v1"}},
+				nil,
+				nil,
+			}))
+		})
 	})
 
 	It("copies values", func() {
@@ -220,6 +1395,22 @@ var _ = Describe("Sorter", func() {
 		Expect(drain(subject)).To(BeEmpty())
 	})
 
+	It("stops reading ahead when closed early", func() {
+		for i := 0; i < 50_000; i++ {
+			Expect(subject.Put([]byte(fmt.Sprintf("%08d", (i*7919)%50_000)), bytes.Repeat([]byte{'x'}, 100))).To(Succeed())
+		}
+
+		before := runtime.NumGoroutine()
+		iter, err := subject.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(iter.Next()).To(BeTrue())
+		Expect(string(iter.Key())).To(Equal("00000000"))
+		Expect(runtime.NumGoroutine()).To(BeNumerically(">", before))
+
+		Expect(iter.Close()).To(Succeed())
+		Expect(runtime.NumGoroutine()).To(Equal(before))
+	})
+
 	It("sorts large data sets with constant memory", func() {
 		val := bytes.Repeat([]byte{'x'}, 1024)
 
@@ -273,6 +1464,41 @@ func TestSuite(t *testing.T) {
 
 // --------------------------------------------------------------------
 
+// concatValues is a Combine func, which concatenates values.
+func concatValues(_, a, b []byte) []byte {
+	return append(append([]byte{}, a...), b...)
+}
+
+// optionVariants are common option variants, which are tested against
+// each other.
+var optionVariants = map[string]extsort.Options{
+	"default":                       {},
+	"stable":                        {Stable: true},
+	"secondary sort":                {CompareValue: bytes.Compare},
+	"de-duplicated":                 {Dedupe: bytes.Equal},
+	"de-duplicated, keep first":     {Dedupe: bytes.Equal, DedupePolicy: extsort.DedupeKeepFirst},
+	"combined":                      {Combine: concatValues},
+	"replacement selection":         {ReplacementSelection: true},
+	"replacement selection, stable": {ReplacementSelection: true, Stable: true},
+	"compaction":                    {MaxRuns: 2},
+	"parallel merge":                {MergeWorkers: 4},
+	"limited":                       {Limit: 3},
+	"compressed":                    {Compression: extsort.CompressionSnappy},
+}
+
+// optionEntries returns table entries for the named option variants.
+func optionEntries(names ...string) []TableEntry {
+	entries := make([]TableEntry, 0, len(names))
+	for _, name := range names {
+		opt, ok := optionVariants[name]
+		if !ok {
+			panic("unknown option variant " + name)
+		}
+		entries = append(entries, Entry(name, opt))
+	}
+	return entries
+}
+
 func seedData() (string, error) {
 	f, err := ioutil.TempFile("", "extsort-test")
 	if err != nil {
@@ -0,0 +1,107 @@
+package extsort
+
+// GroupIterator iterates over groups of equal keys.
+type GroupIterator struct {
+	iter  *Iterator
+	equal Equal
+
+	key    []byte
+	vals   *ValueIterator
+	peeked bool // iter is positioned at the first item of the next group
+}
+
+// NewGroupIterator wraps a sorted iterator and groups items by equal keys.
+// If equal is nil, keys are grouped using Options.Compare.
+//
+// Please note that the items of each group are only visible if the sorter
+// was not configured to Dedupe.
+func NewGroupIterator(iter *Iterator, equal Equal) *GroupIterator {
+	if equal == nil {
+		compare := iter.heap.compare
+		equal = func(a, b []byte) bool { return compare(a, b) == 0 }
+	}
+	return &GroupIterator{iter: iter, equal: equal}
+}
+
+// Next advances to the next group and returns true if successful.
+// Any unconsumed values of the current group are skipped.
+func (g *GroupIterator) Next() bool {
+	if g.vals != nil {
+		for g.vals.Next() {
+		}
+		g.vals = nil
+	}
+
+	if !g.peeked && !g.iter.Next() {
+		return false
+	}
+
+	g.peeked = true
+	g.key = append(g.key[:0], g.iter.Key()...)
+	g.vals = &ValueIterator{g: g}
+	return true
+}
+
+// Key returns the key of the current group.
+func (g *GroupIterator) Key() []byte {
+	return g.key
+}
+
+// Values returns an iterator over the items of the current group.
+// It is only valid until the next call to Next.
+func (g *GroupIterator) Values() *ValueIterator {
+	return g.vals
+}
+
+// Err returns the error, if occurred.
+func (g *GroupIterator) Err() error {
+	return g.iter.Err()
+}
+
+// Close closes the iterator.
+func (g *GroupIterator) Close() error {
+	return g.iter.Close()
+}
+
+// --------------------------------------------------------------------
+
+// ValueIterator iterates over the items of a single group.
+type ValueIterator struct {
+	g    *GroupIterator
+	done bool
+}
+
+// Next advances to the next item within the group and returns true if
+// successful.
+func (v *ValueIterator) Next() bool {
+	if v.done {
+		return false
+	}
+
+	g := v.g
+	if g.peeked {
+		g.peeked = false
+		return true
+	}
+
+	if !g.iter.Next() {
+		v.done = true
+		return false
+	}
+	if !g.equal(g.iter.Key(), g.key) {
+		v.done = true
+		g.peeked = true
+		return false
+	}
+	return true
+}
+
+// Key returns the key at the current cursor position.
+func (v *ValueIterator) Key() []byte {
+	return v.g.iter.Key()
+}
+
+// Value returns the value at the current cursor position.
+func (v *ValueIterator) Value() []byte {
+	return v.g.iter.Value()
+}
@@ -0,0 +1,120 @@
+package extsort_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("GroupIterator", func() {
+	var sorter *extsort.Sorter
+	var workDir string
+
+	groups := func(iter *extsort.GroupIterator, max int) (map[string][]string, []string, error) {
+		defer iter.Close()
+
+		vals := make(map[string][]string)
+		order := make([]string, 0)
+		for iter.Next() {
+			key := string(iter.Key())
+			order = append(order, key)
+
+			vi := iter.Values()
+			for n := 0; n != max && vi.Next(); n++ {
+				vals[key] = append(vals[key], string(vi.Value()))
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return nil, nil, err
+		}
+		return vals, order, iter.Close()
+	}
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+
+		sorter = extsort.New(&extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+		})
+	})
+
+	AfterEach(func() {
+		Expect(sorter.Close()).To(Succeed())
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	It("groups items by key", func() {
+		for i := 0; i < 30_000; i++ {
+			key := fmt.Sprintf("k%02d", i%7)
+			Expect(sorter.Put([]byte(key), []byte(fmt.Sprintf("v%05d", i)))).To(Succeed())
+		}
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		vals, order, err := groups(extsort.NewGroupIterator(iter, nil), -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(order).To(Equal([]string{"k00", "k01", "k02", "k03", "k04", "k05", "k06"}))
+		Expect(vals["k00"]).To(HaveLen(4286))
+		Expect(vals["k06"]).To(HaveLen(4285))
+		Expect(vals["k03"][0]).To(Equal("v29998"))
+		Expect(vals["k03"][4285]).To(Equal("v00003"))
+	})
+
+	It("skips unconsumed values", func() {
+		for i := 0; i < 1000; i++ {
+			key := fmt.Sprintf("k%02d", i%3)
+			Expect(sorter.Put([]byte(key), []byte(fmt.Sprintf("v%03d", i)))).To(Succeed())
+		}
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		vals, order, err := groups(extsort.NewGroupIterator(iter, nil), 2)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(order).To(Equal([]string{"k00", "k01", "k02"}))
+		Expect(vals).To(Equal(map[string][]string{
+			"k00": {"v999", "v996"},
+			"k01": {"v997", "v994"},
+			"k02": {"v998", "v995"},
+		}))
+	})
+
+	It("supports custom equality", func() {
+		Expect(sorter.Put([]byte("a:1"), []byte("v1"))).To(Succeed())
+		Expect(sorter.Put([]byte("b:1"), []byte("v2"))).To(Succeed())
+		Expect(sorter.Put([]byte("a:2"), []byte("v3"))).To(Succeed())
+		Expect(sorter.Put([]byte("c:1"), []byte("v4"))).To(Succeed())
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		prefix := func(a, b []byte) bool { return bytes.Equal(a[:2], b[:2]) }
+		vals, order, err := groups(extsort.NewGroupIterator(iter, prefix), -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(order).To(Equal([]string{"a:1", "b:1", "c:1"}))
+		Expect(vals).To(Equal(map[string][]string{
+			"a:1": {"v1", "v3"},
+			"b:1": {"v2"},
+			"c:1": {"v4"},
+		}))
+	})
+
+	It("does not fail when blank", func() {
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+
+		_, order, err := groups(extsort.NewGroupIterator(iter, nil), -1)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(order).To(BeEmpty())
+	})
+})
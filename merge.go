@@ -0,0 +1,58 @@
+package extsort
+
+// Source is a sorted input.
+type Source interface {
+	// Next advances the source to the next item and returns true if
+	// successful.
+	Next() bool
+	// Key returns the key at the current cursor position.
+	Key() []byte
+	// Value returns the value at the current cursor position.
+	Value() []byte
+	// Err returns the error, if occurred.
+	Err() error
+}
+
+var _ Source = (*Iterator)(nil)
+
+// Merge merges multiple pre-sorted sources into a single iterator, applying
+// the same ordering, de-duplication and combination rules as a Sorter.
+// Items of later sources are considered to be added more recently than
+// items of earlier ones.
+//
+// Sources must be sorted according to opt.Compare (and opt.CompareValue, if
+// set). The caller remains responsible for closing them after the
+// iterator has been closed.
+func Merge(opt *Options, sources ...Source) *Iterator {
+	opt = opt.norm()
+
+	sections := make([]section, 0, len(sources))
+	for _, src := range sources {
+		sections = append(sections, &sourceSection{src: src})
+	}
+
+	iter, err := newIterator(sections, opt)
+	if err != nil {
+		return &Iterator{heap: &minHeap{compare: opt.Compare}, opt: opt, err: err}
+	}
+	return iter
+}
+
+// sourceSection adapts a Source to a section.
+type sourceSection struct {
+	src Source
+}
+
+func (s *sourceSection) ReadNext() (*entry, error) {
+	if !s.src.Next() {
+		return nil, s.src.Err()
+	}
+
+	key, val := s.src.Key(), s.src.Value()
+	ent := fetchEntry(len(key), len(val))
+	n := copy(ent.data, key)
+	copy(ent.data[n:], val)
+	return ent, nil
+}
+
+func (*sourceSection) Close() error { return nil }
@@ -0,0 +1,111 @@
+package extsort_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("Merge", func() {
+	drain := func(iter *extsort.Iterator) ([][2]string, error) {
+		defer iter.Close()
+
+		read := make([][2]string, 0, 4)
+		for iter.Next() {
+			read = append(read, [2]string{string(iter.Key()), string(iter.Value())})
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		return read, iter.Close()
+	}
+
+	It("merges sources", func() {
+		iter := extsort.Merge(nil,
+			&sliceSource{pairs: [][2]string{{"bar", "v1"}, {"foo", "v2"}}},
+			&sliceSource{pairs: [][2]string{{"baz", "v3"}, {"dau", "v4"}, {"foo", "v5"}}},
+			&sliceSource{},
+			&sliceSource{pairs: [][2]string{{"bar", "v6"}}},
+		)
+		Expect(drain(iter)).To(Equal([][2]string{
+			{"bar", "v6"},
+			{"bar", "v1"},
+			{"baz", "v3"},
+			{"dau", "v4"},
+			{"foo", "v5"},
+			{"foo", "v2"},
+		}))
+	})
+
+	It("de-duplicates", func() {
+		iter := extsort.Merge(&extsort.Options{Dedupe: bytes.Equal},
+			&sliceSource{pairs: [][2]string{{"bar", "v1"}, {"foo", "v2"}}},
+			&sliceSource{pairs: [][2]string{{"baz", "v3"}, {"foo", "v4"}}},
+		)
+		Expect(drain(iter)).To(Equal([][2]string{
+			{"bar", "v1"},
+			{"baz", "v3"},
+			{"foo", "v4"},
+		}))
+	})
+
+	It("merges sorted iterators", func() {
+		sorters := make([]*extsort.Sorter, 3)
+		sources := make([]extsort.Source, 0, len(sorters))
+		for i := range sorters {
+			sorters[i] = extsort.New(&extsort.Options{BufferSize: 64 * 1024})
+			defer sorters[i].Close()
+
+			for j := 0; j < 10_000; j++ {
+				key := fmt.Sprintf("%05d", (j*7919+i)%30_000)
+				Expect(sorters[i].Append([]byte(key))).To(Succeed())
+			}
+
+			iter, err := sorters[i].Sort()
+			Expect(err).NotTo(HaveOccurred())
+			defer iter.Close()
+
+			sources = append(sources, iter)
+		}
+
+		pairs, err := drain(extsort.Merge(nil, sources...))
+		Expect(err).NotTo(HaveOccurred())
+		Expect(pairs).To(HaveLen(30_000))
+		Expect(pairs[0][0]).To(Equal("00000"))
+		Expect(pairs[29_999][0]).To(Equal("29999"))
+	})
+
+	It("propagates errors", func() {
+		errFailed := errors.New("failed")
+		iter := extsort.Merge(nil,
+			&sliceSource{pairs: [][2]string{{"bar", "v1"}, {"foo", "v2"}}},
+			&sliceSource{err: errFailed},
+		)
+		Expect(iter.Next()).To(BeFalse())
+		Expect(iter.Err()).To(MatchError(errFailed))
+		Expect(iter.Close()).To(Succeed())
+	})
+})
+
+type sliceSource struct {
+	pairs [][2]string
+	pos   int
+	err   error
+}
+
+func (s *sliceSource) Next() bool {
+	if s.err != nil || s.pos >= len(s.pairs) {
+		return false
+	}
+	s.pos++
+	return true
+}
+
+func (s *sliceSource) Key() []byte   { return []byte(s.pairs[s.pos-1][0]) }
+func (s *sliceSource) Value() []byte { return []byte(s.pairs[s.pos-1][1]) }
+func (s *sliceSource) Err() error    { return s.err }
@@ -2,9 +2,54 @@ package extsort
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"sort"
 )
 
+// ErrDuplicateKey is returned when duplicates are found and the
+// DedupeError policy is used. Use errors.As with a *DuplicateKeyError to
+// obtain the offending key.
+var ErrDuplicateKey = errors.New("extsort: duplicate key")
+
+// DuplicateKeyError is returned when duplicates are found and the
+// DedupeError policy is used.
+type DuplicateKeyError struct {
+	Key []byte
+}
+
+func (e *DuplicateKeyError) Error() string {
+	return fmt.Sprintf("%s %q", ErrDuplicateKey, e.Key)
+}
+
+// Is implements errors.Is.
+func (e *DuplicateKeyError) Is(target error) bool {
+	return target == ErrDuplicateKey
+}
+
+// minBufferSize is the min BufferSize.
+const minBufferSize = 1 << 16
+
+// DedupePolicy defines how duplicates are handled.
+type DedupePolicy uint8
+
+// Supported de-duplication policies.
+const (
+	// DedupeKeepLast keeps the last added item.
+	DedupeKeepLast DedupePolicy = iota
+	// DedupeKeepFirst keeps the first added item.
+	DedupeKeepFirst
+	// DedupeError fails with a *DuplicateKeyError.
+	DedupeError
+)
+
+func (p DedupePolicy) norm() DedupePolicy {
+	if p > DedupeError {
+		return DedupeKeepLast
+	}
+	return p
+}
+
 // Compares byte chunks. -1 for a < b and 0 for a == b.
 type Compare func(a, b []byte) int
 
@@ -29,21 +74,143 @@ type Options struct {
 	// Default: bytes.Compare
 	Compare Compare
 
-	// Sort defines the sort function that is used.
+	// Sort defines the sort function that is used. Unless set, sorting is
+	// skipped for input that is already in ascending or descending order.
 	// Default: sort.Sort
 	Sort func(sort.Interface)
 
+	// CompareValue optionally defines the order of items with equal keys
+	// by comparing their values (secondary sort).
+	// When set, DedupePolicy and Combine follow value rather than insertion
+	// order, i.e. DedupeKeepFirst keeps the item with the lowest and
+	// DedupeKeepLast the item with the highest value.
+	// Default: nil (= order by insertion)
+	CompareValue Compare
+
+	// Stable preserves the insertion order of items with equal keys (and
+	// values, if CompareValue is set).
+	// Default: false (= most recently added items first)
+	Stable bool
+
 	// Dedupe defines the compare function for de-duplication.
 	// Default: nil (= do not de-dupe)
-	// Keeps the last added item.
 	Dedupe Equal
 
-	// BufferSize limits the memory buffer used for sorting.
+	// DedupePolicy defines which item to keep when de-duplicating.
+	// Default: DedupeKeepLast
+	DedupePolicy DedupePolicy
+
+	// BufferSize limits the memory buffer used for sorting. When merging,
+	// the same budget is used to read ahead and decode temporary output in
+	// the background.
 	// Default: 64MiB (must be at least 64KiB)
 	BufferSize int
 
 	// Compression optionally uses compression for temporary output.
 	Compression Compression
+
+	// Combine optionally merges the values of items with equal keys into a
+	// single item, where a was added before b. It is applied when writing
+	// temporary output and again when merging. Keys are considered equal if
+	// Dedupe returns true or, if not set, if Compare returns 0.
+	// Default: nil (= do not combine)
+	Combine func(key, a, b []byte) []byte
+
+	// Limit restricts the output to the first N items (top-K).
+	// Items are retained in a bounded heap and only spilled to disk if
+	// Limit items exceed the BufferSize.
+	// Default: 0 (= unlimited)
+	Limit int
+
+	// MergeWorkers enables a parallel merge of temporary output. Keys are
+	// split into disjoint ranges which are merged concurrently by the given
+	// number of workers and emitted in order. Dedupe must only consider
+	// keys equal if Compare returns 0.
+	// Default: 0 (= single-threaded merge)
+	MergeWorkers int
+
+	// ReplacementSelection generates temporary runs by replacement selection.
+	// The buffer is maintained as a heap and the smallest items are written
+	// while new items are accepted. On random input, runs average twice the
+	// BufferSize; nearly sorted input results in a single run. It is ignored
+	// in limit mode.
+	// Default: false
+	ReplacementSelection bool
+
+	// MaxRuns enables background compaction of temporary runs. Once more
+	// than MaxRuns runs have been written, adjacent runs are merged into
+	// larger ones while items continue to be added, so that the final merge
+	// starts with fewer runs. Adding items is blocked while there are more
+	// than twice as many runs. Compaction uses additional disk space and
+	// I/O. It is ignored in limit mode.
+	// Default: 0 (= no compaction)
+	MaxRuns int
+
+	// ValueThreshold enables key-value separation. Values of at least
+	// ValueThreshold bytes are written to a temporary value log as they are
+	// added and only keys and pointers are sorted. Values are read from the
+	// log on demand. It is ignored in limit mode or if CompareValue or
+	// Combine are set.
+	// Default: 0 (= disabled)
+	ValueThreshold int
+}
+
+// keyEqual returns the func used to identify items to de-dupe or combine.
+func (o *Options) keyEqual() Equal {
+	if o.Dedupe != nil {
+		return o.Dedupe
+	}
+	if o.Combine != nil {
+		compare := o.Compare
+		return func(a, b []byte) bool { return compare(a, b) == 0 }
+	}
+	return nil
+}
+
+// keepTail returns true if de-duplication retains the last rather than the
+// first of equal items in sort order.
+func (o *Options) keepTail() bool {
+	if o.CompareValue != nil {
+		return o.DedupePolicy == DedupeKeepLast
+	}
+	return o.Stable == (o.DedupePolicy == DedupeKeepLast)
+}
+
+// follows returns true if an item added now sorts at or after a previously
+// added item.
+func (o *Options) follows(key, value, prevKey, prevValue []byte) bool {
+	c := o.Compare(key, prevKey)
+	if c == 0 && o.CompareValue != nil {
+		c = o.CompareValue(value, prevValue)
+	}
+	if c != 0 {
+		return c > 0
+	}
+	return o.Stable
+}
+
+// combineSorted applies Combine to values a and b, where a precedes b in
+// sort order.
+func (o *Options) combineSorted(key, a, b []byte) []byte {
+	if o.Stable || o.CompareValue != nil {
+		return o.Combine(key, a, b)
+	}
+	return o.Combine(key, b, a)
+}
+
+// separateValues returns true if values can be stored in a value log.
+func (o *Options) separateValues() bool {
+	return o.Limit < 1 && o.CompareValue == nil && o.Combine == nil
+}
+
+// valueLog returns true if key-value separation is enabled.
+func (o *Options) valueLog() bool {
+	return o.ValueThreshold > 0
+}
+
+// separate returns true if value is stored in a value log.
+func (o *Options) separate(value []byte) bool {
+	return o.ValueThreshold > 0 && len(value) >= o.ValueThreshold
 }
 
 func (o *Options) norm() *Options {
@@ -62,11 +229,25 @@ func (o *Options) norm() *Options {
 
 	if std := (1 << 26); opt.BufferSize < 1 {
 		opt.BufferSize = std
-	} else if min := (1 << 16); opt.BufferSize < min {
-		opt.BufferSize = min
+	} else if opt.BufferSize < minBufferSize {
+		opt.BufferSize = minBufferSize
 	}
 
 	opt.Compression = opt.Compression.norm()
+	opt.DedupePolicy = opt.DedupePolicy.norm()
+
+	if opt.Limit < 0 {
+		opt.Limit = 0
+	}
+	if opt.MergeWorkers < 0 {
+		opt.MergeWorkers = 0
+	}
+	if opt.MaxRuns < 0 || opt.Limit > 0 {
+		opt.MaxRuns = 0
+	}
+	if opt.ValueThreshold < 0 || !opt.separateValues() {
+		opt.ValueThreshold = 0
+	}
 
 	return &opt
 }
@@ -0,0 +1,351 @@
+package extsort
+
+import (
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	mergePartitionsPerWorker = 4
+	mergeBatchSize           = 64 << 10 // 64k
+)
+
+// keyRange is a range of keys between two splitters. The lower bound is
+// exclusive, the upper bound is inclusive.
+type keyRange struct {
+	lo, hi       []byte
+	hasLo, hasHi bool
+}
+
+// runIndex is the block index of a run.
+type runIndex struct {
+	ra     io.ReaderAt
+	blocks []blockHandle
+}
+
+// readRunIndexes reads the block indexes of the given runs. Block offsets
+// are adjusted to be absolute.
+func readRunIndexes(runs []tempRun) ([]runIndex, error) {
+	indexes := make([]runIndex, 0, len(runs))
+	for _, run := range runs {
+		_, index, ok, err := readBlockFileIndex(io.NewSectionReader(run.ra, run.offset, run.size), run.size, runMagic, runVersion)
+		if err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrInvalidRun
+		}
+
+		for i := range index {
+			index[i].offset += run.offset
+		}
+		indexes = append(indexes, runIndex{ra: run.ra, blocks: index})
+	}
+	return indexes, nil
+}
+
+// pickSplitters picks up to n-1 distinct splitter keys from the last keys
+// of all blocks, dividing the runs into n ranges of similar size. Keys are
+// weighted by the size of their blocks.
+func pickSplitters(runs []runIndex, compare Compare, n int) [][]byte {
+	var blocks []blockHandle
+	var total int64
+	for _, run := range runs {
+		blocks = append(blocks, run.blocks...)
+		for _, bh := range run.blocks {
+			total += bh.size
+		}
+	}
+	sort.Slice(blocks, func(i, j int) bool { return compare(blocks[i].lastKey, blocks[j].lastKey) < 0 })
+
+	var splitters [][]byte
+	var sum int64
+	for i, p := 0, 1; i < len(blocks) && p < n; i++ {
+		if sum += blocks[i].size; sum*int64(n) < total*int64(p) {
+			continue
+		}
+		for p < n && sum*int64(n) >= total*int64(p) {
+			p++
+		}
+
+		key := blocks[i].lastKey
+		if len(splitters) != 0 && compare(key, splitters[len(splitters)-1]) == 0 {
+			continue
+		}
+		splitters = append(splitters, key)
+	}
+	return splitters
+}
+
+// keyRanges splits all keys into contiguous ranges at the given splitters.
+func keyRanges(splitters [][]byte) []keyRange {
+	ranges := make([]keyRange, 0, len(splitters)+1)
+	for p := 0; p <= len(splitters); p++ {
+		var kr keyRange
+		if p > 0 {
+			kr.lo, kr.hasLo = splitters[p-1], true
+		}
+		if p < len(splitters) {
+			kr.hi, kr.hasHi = splitters[p], true
+		}
+		ranges = append(ranges, kr)
+	}
+	return ranges
+}
+
+// newRangeSections returns a section for each run, limited to a key range.
+func newRangeSections(compress Compression, runs []runIndex, compare Compare, kr keyRange) []section {
+	sections := make([]section, 0, len(runs))
+	for _, run := range runs {
+		sections = append(sections, newRangeSection(compress, run, compare, kr))
+	}
+	return sections
+}
+
+// --------------------------------------------------------------------
+
+// rangeSection reads the entries of a run within a key range.
+type rangeSection struct {
+	ra      io.ReaderAt
+	br      blockReader
+	blocks  []blockHandle
+	it      blockIter
+	compare Compare
+	kr      keyRange
+}
+
+func newRangeSection(compress Compression, run runIndex, compare Compare, kr keyRange) *rangeSection {
+	// skip blocks that only contain keys below the range
+	blocks := run.blocks
+	if kr.hasLo {
+		n := sort.Search(len(blocks), func(i int) bool { return compare(blocks[i].lastKey, kr.lo) > 0 })
+		blocks = blocks[n:]
+	}
+
+	return &rangeSection{
+		ra:      run.ra,
+		br:      blockReader{compress: compress},
+		it:      blockIter{kinds: true},
+		blocks:  blocks,
+		compare: compare,
+		kr:      kr,
+	}
+}
+
+func (s *rangeSection) ReadNext() (*entry, error) {
+	for {
+		for !s.it.Next() {
+			if s.it.err != nil {
+				return nil, s.it.err
+			}
+			if len(s.blocks) == 0 {
+				return nil, nil
+			}
+
+			bh := s.blocks[0]
+			s.blocks = s.blocks[1:]
+
+			kind, data, err := s.br.ReadAt(s.ra, bh.offset, bh.size)
+			if err != nil {
+				return nil, err
+			} else if kind != blockKindData {
+				return nil, ErrCorrupt
+			}
+			s.it.Reset(data)
+		}
+
+		if s.kr.hasHi && s.compare(s.it.key, s.kr.hi) > 0 {
+			s.blocks = nil
+			s.it.Reset(nil)
+			return nil, nil
+		}
+		if s.kr.hasLo && s.compare(s.it.key, s.kr.lo) <= 0 {
+			continue
+		}
+
+		return s.it.Entry(), nil
+	}
+}
+
+func (s *rangeSection) Close() error {
+	s.blocks = nil
+	s.it.Reset(nil)
+	s.br.buf = nil
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+// mergeBatch is a batch of merged entries.
+type mergeBatch struct {
+	ents []*entry
+	err  error
+}
+
+// mergePartition is a key range merged by a worker.
+type mergePartition struct {
+	sections []section
+	out      chan mergeBatch
+}
+
+// parallelMerge merges disjoint key ranges of the runs concurrently and
+// emits the results in order. It implements the section interface.
+type parallelMerge struct {
+	opt   *Options
+	parts []*mergePartition
+	quit  chan struct{}
+	wg    sync.WaitGroup
+
+	cur   int
+	batch []*entry
+	pos   int
+}
+
+// newParallelMerge starts merging the given runs with opt.MergeWorkers
+// workers, buffering up to budget bytes of merged entries. It returns nil if
+// the runs cannot be split into multiple ranges.
+func newParallelMerge(tempRuns []tempRun, opt *Options, budget int) (*parallelMerge, error) {
+	runs, err := readRunIndexes(tempRuns)
+	if err != nil {
+		return nil, err
+	}
+
+	splitters := pickSplitters(runs, opt.Compare, opt.MergeWorkers*mergePartitionsPerWorker)
+	if len(splitters) == 0 {
+		return nil, nil
+	}
+
+	// bound the memory used by pending batches
+	numParts := len(splitters) + 1
+	pending := budget / (numParts * mergeBatchSize)
+	if pending < 1 {
+		pending = 1
+	}
+
+	m := &parallelMerge{
+		opt:   opt,
+		parts: make([]*mergePartition, 0, numParts),
+		quit:  make(chan struct{}),
+	}
+	queue := make(chan *mergePartition, numParts)
+	for _, kr := range keyRanges(splitters) {
+		part := &mergePartition{
+			sections: newRangeSections(opt.Compression, runs, opt.Compare, kr),
+			out:      make(chan mergeBatch, pending),
+		}
+		m.parts = append(m.parts, part)
+		queue <- part
+	}
+	close(queue)
+
+	for w := 0; w < opt.MergeWorkers; w++ {
+		m.wg.Add(1)
+		go func() {
+			defer m.wg.Done()
+
+			// partitions are picked in order, so the one read by the
+			// consumer is always in progress or complete
+			for part := range queue {
+				if !m.merge(part) {
+					return
+				}
+			}
+		}()
+	}
+	return m, nil
+}
+
+// ReadNext returns the next entry or nil when all partitions are exhausted.
+func (m *parallelMerge) ReadNext() (*entry, error) {
+	for {
+		if m.pos < len(m.batch) {
+			ent := m.batch[m.pos]
+			m.batch[m.pos] = nil
+			m.pos++
+			return ent, nil
+		}
+		if m.cur == len(m.parts) {
+			return nil, nil
+		}
+
+		b, ok := <-m.parts[m.cur].out
+		if !ok {
+			m.cur++
+			continue
+		}
+		if b.err != nil {
+			return nil, b.err
+		}
+		m.batch, m.pos = b.ents, 0
+	}
+}
+
+// Close stops the workers and waits for them to exit.
+func (m *parallelMerge) Close() error {
+	select {
+	case <-m.quit:
+		return nil
+	default:
+	}
+
+	close(m.quit)
+	m.wg.Wait()
+
+	for _, ent := range m.batch[m.pos:] {
+		ent.Release()
+	}
+	m.batch, m.pos = nil, 0
+	m.cur = len(m.parts)
+	return nil
+}
+
+// merge merges a partition and returns false if stopped.
+func (m *parallelMerge) merge(part *mergePartition) bool {
+	defer close(part.out)
+
+	iter, err := newIterator(part.sections, m.opt)
+	if err != nil {
+		return m.send(part, mergeBatch{err: err})
+	}
+	defer iter.Close()
+
+	var ents []*entry
+	var size int
+	for iter.Next() {
+		// take ownership of the current entry
+		ent := iter.ent
+		iter.ent = nil
+
+		ents = append(ents, ent)
+		if size += len(ent.data); size >= mergeBatchSize {
+			if !m.send(part, mergeBatch{ents: ents}) {
+				return false
+			}
+			ents, size = nil, 0
+		}
+	}
+	if err := iter.Err(); err != nil {
+		releaseEntries(ents)
+		return m.send(part, mergeBatch{err: err})
+	}
+	if len(ents) != 0 {
+		return m.send(part, mergeBatch{ents: ents})
+	}
+	return true
+}
+
+func (m *parallelMerge) send(part *mergePartition, b mergeBatch) bool {
+	select {
+	case part.out <- b:
+		return true
+	case <-m.quit:
+		releaseEntries(b.ents)
+		return false
+	}
+}
+
+func releaseEntries(ents []*entry) {
+	for _, ent := range ents {
+		ent.Release()
+	}
+}
@@ -0,0 +1,188 @@
+package extsort
+
+import (
+	"bytes"
+	"errors"
+	"hash/fnv"
+	"io"
+)
+
+// ErrPartitionRange is returned when a Partitioner returns an invalid
+// partition.
+var ErrPartitionRange = errors.New("extsort: partition out of range")
+
+// Partitioner assigns a key to one of n partitions, returning a partition
+// in the range [0, n).
+type Partitioner func(key []byte, n int) int
+
+// HashPartitioner assigns keys to partitions by their FNV-1a hash.
+func HashPartitioner(key []byte, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write(key)
+	return int(h.Sum32() % uint32(n))
+}
+
+// PartitionedSorter routes items into a number of partitions and sorts each
+// partition individually. All partitions share a single memory buffer of
+// Options.BufferSize and a single temporary file.
+type PartitionedSorter struct {
+	opt       *Options
+	partition Partitioner
+	sorters   []*Sorter
+	tw        *tempWriter
+	vlog      *valueLog
+	size      int // total buffered size
+}
+
+// NewPartitioned inits a sorter with n partitions. Items are assigned to
+// partitions using the partition func, HashPartitioner if nil. Limit,
+// ReplacementSelection and MaxRuns are not supported and ignored.
+func NewPartitioned(n int, partition Partitioner, opt *Options) *PartitionedSorter {
+	if n < 1 {
+		n = 1
+	}
+	if partition == nil {
+		partition = HashPartitioner
+	}
+
+	detect := opt == nil || opt.Sort == nil
+	opt = opt.norm()
+	opt.Limit = 0
+	opt.ReplacementSelection = false
+	opt.MaxRuns = 0
+
+	vlog := newValueLog(opt.WorkDir, opt.KeepFiles)
+	sorters := make([]*Sorter, 0, n)
+	for i := 0; i < n; i++ {
+		s := newSorter(opt, detect)
+		s.mergeRuns = false // runs of partitions are interleaved
+		s.vlog = vlog
+		sorters = append(sorters, s)
+	}
+	return &PartitionedSorter{opt: opt, partition: partition, sorters: sorters, vlog: vlog}
+}
+
+// Append appends a data chunk to the sorter.
+func (p *PartitionedSorter) Append(data []byte) error {
+	return p.Put(data, nil)
+}
+
+// Put inserts a key value pair into the partition assigned to key.
+func (p *PartitionedSorter) Put(key, value []byte) error {
+	if p.opt.separate(value) {
+		return p.PutReader(key, bytes.NewReader(value))
+	}
+	return p.put(recordValue, key, value)
+}
+
+// PutReader inserts a key and a value read from r into the partition
+// assigned to key. See Sorter.PutReader.
+func (p *PartitionedSorter) PutReader(key []byte, r io.Reader) error {
+	if !p.opt.valueLog() {
+		value, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		return p.put(recordValue, key, value)
+	}
+
+	ptr, err := p.vlog.Write(r)
+	if err != nil {
+		return err
+	}
+	return p.put(recordPointer, key, ptr)
+}
+
+func (p *PartitionedSorter) put(kind recordKind, key, value []byte) error {
+	n := p.partition(key, len(p.sorters))
+	if n < 0 || n >= len(p.sorters) {
+		return ErrPartitionRange
+	}
+
+	for p.size > 0 && p.size+len(key)+len(value) > p.opt.BufferSize {
+		if err := p.flushLargest(); err != nil {
+			return err
+		}
+	}
+
+	p.sorters[n].buf.AppendKind(kind, key, value)
+	p.size += len(key) + len(value)
+	return nil
+}
+
+// Sort applies the sort algorithm and returns an iterator for each
+// partition. The iterators may be consumed concurrently and must all be
+// closed.
+func (p *PartitionedSorter) Sort() ([]*Iterator, error) {
+	if err := p.init(); err != nil {
+		return nil, err
+	}
+
+	iters := make([]*Iterator, 0, len(p.sorters))
+	for _, s := range p.sorters {
+		iter, err := s.sort(p.opt.BufferSize / len(p.sorters))
+		if err != nil {
+			for _, iter := range iters {
+				_ = iter.Close()
+			}
+			return nil, err
+		}
+		iters = append(iters, iter)
+	}
+	p.size = 0
+	return iters, nil
+}
+
+// Close stops the processing and removes temporary files.
+func (p *PartitionedSorter) Close() (err error) {
+	if p.tw != nil {
+		err = p.tw.Close()
+	}
+	if e := p.vlog.Close(); e != nil {
+		err = e
+	}
+	return
+}
+
+// Size returns the buffered and written size, including values written to
+// the value log.
+func (p *PartitionedSorter) Size() int64 {
+	sum := int64(p.size) + p.vlog.Size()
+	if p.tw == nil {
+		return sum
+	}
+	return sum + p.tw.Size()
+}
+
+// init creates the shared temporary file.
+func (p *PartitionedSorter) init() error {
+	if p.tw != nil {
+		return nil
+	}
+
+	tw, err := newTempWriter(p.opt.WorkDir, p.opt.Compression, p.opt.KeepFiles)
+	if err != nil {
+		return err
+	}
+	p.tw = tw
+	for _, s := range p.sorters {
+		s.tw = tw
+	}
+	return nil
+}
+
+// flushLargest writes the largest partition buffer to disk.
+func (p *PartitionedSorter) flushLargest() error {
+	if err := p.init(); err != nil {
+		return err
+	}
+
+	largest := p.sorters[0]
+	for _, s := range p.sorters[1:] {
+		if s.buf.ByteSize() > largest.buf.ByteSize() {
+			largest = s
+		}
+	}
+	p.size -= largest.buf.ByteSize()
+	return largest.flush()
+}
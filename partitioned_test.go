@@ -0,0 +1,135 @@
+package extsort_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("PartitionedSorter", func() {
+	var workDir string
+
+	drain := func(p *extsort.PartitionedSorter) ([][][2]string, error) {
+		iters, err := p.Sort()
+		if err != nil {
+			return nil, err
+		}
+
+		parts := make([][][2]string, 0, len(iters))
+		for _, iter := range iters {
+			var part [][2]string
+			for iter.Next() {
+				part = append(part, [2]string{string(iter.Key()), string(iter.Value())})
+			}
+			if err := iter.Err(); err != nil {
+				return nil, err
+			}
+			if err := iter.Close(); err != nil {
+				return nil, err
+			}
+			parts = append(parts, part)
+		}
+		return parts, nil
+	}
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	It("sorts partitions", func() {
+		byFirstChar := func(key []byte, n int) int { return int(key[0]-'a') % n }
+		subject := extsort.NewPartitioned(2, byFirstChar, &extsort.Options{WorkDir: workDir})
+		defer subject.Close()
+
+		Expect(subject.Put([]byte("bar"), []byte("v1"))).To(Succeed())
+		Expect(subject.Put([]byte("foo"), []byte("v2"))).To(Succeed())
+		Expect(subject.Put([]byte("baz"), []byte("v3"))).To(Succeed())
+		Expect(subject.Put([]byte("dau"), []byte("v4"))).To(Succeed())
+		Expect(subject.Put([]byte("ape"), []byte("v5"))).To(Succeed())
+		Expect(subject.Put([]byte("bar"), []byte("v6"))).To(Succeed())
+		Expect(drain(subject)).To(Equal([][][2]string{
+			{{"ape", "v5"}},
+			{{"bar", "v6"}, {"bar", "v1"}, {"baz", "v3"}, {"dau", "v4"}, {"foo", "v2"}},
+		}))
+	})
+
+	It("shares memory and temporary storage", func() {
+		subject := extsort.NewPartitioned(4, nil, &extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			KeepFiles:  true,
+			Dedupe:     bytes.Equal,
+		})
+		defer subject.Close()
+
+		for i := 0; i < 50_000; i++ {
+			key := fmt.Sprintf("k%05d", (i*7919)%20_000)
+			Expect(subject.Put([]byte(key), []byte("value"))).To(Succeed())
+		}
+		Expect(subject.Size()).To(BeNumerically(">", 64*1024))
+		Expect(filepath.Glob(workDir + "/*")).To(HaveLen(1))
+
+		parts, err := drain(subject)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(parts).To(HaveLen(4))
+
+		var total int
+		for p, part := range parts {
+			Expect(part).NotTo(BeEmpty())
+			Expect(sort.SliceIsSorted(part, func(i, j int) bool { return part[i][0] < part[j][0] })).To(BeTrue())
+			for _, pair := range part {
+				Expect(extsort.HashPartitioner([]byte(pair[0]), 4)).To(Equal(p))
+			}
+			total += len(part)
+		}
+		Expect(total).To(Equal(20_000))
+
+		Expect(subject.Close()).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+	})
+
+	It("shares a value log", func() {
+		byFirstChar := func(key []byte, n int) int { return int(key[0]-'a') % n }
+		subject := extsort.NewPartitioned(2, byFirstChar, &extsort.Options{
+			WorkDir:        workDir,
+			KeepFiles:      true,
+			ValueThreshold: 3,
+		})
+		defer subject.Close()
+
+		Expect(subject.Put([]byte("bar"), []byte("v1"))).To(Succeed())
+		Expect(subject.Put([]byte("foo"), []byte("value2"))).To(Succeed())
+		Expect(subject.PutReader([]byte("ape"), strings.NewReader("value3"))).To(Succeed())
+		Expect(subject.PutReader([]byte("baz"), strings.NewReader("v4"))).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(HaveLen(1))
+		Expect(drain(subject)).To(Equal([][][2]string{
+			{{"ape", "value3"}},
+			{{"bar", "v1"}, {"baz", "v4"}, {"foo", "value2"}},
+		}))
+
+		Expect(subject.Close()).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+	})
+
+	It("rejects invalid partitions", func() {
+		subject := extsort.NewPartitioned(2, func(_ []byte, n int) int { return n }, &extsort.Options{WorkDir: workDir})
+		defer subject.Close()
+
+		Expect(subject.Append([]byte("foo"))).To(MatchError(extsort.ErrPartitionRange))
+	})
+})
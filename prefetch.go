@@ -0,0 +1,116 @@
+package extsort
+
+import (
+	"bufio"
+	"io"
+)
+
+const readAheadMax = 8 // max blocks buffered per run
+
+// readAheadBlocks returns the number of blocks that can be buffered per run
+// when n runs are merged within the given memory budget. It returns 0 if the
+// budget is too small to read ahead.
+func readAheadBlocks(budget, n int) int {
+	if n < 1 {
+		return 0
+	}
+
+	blocks := budget / (n * runBlockSize)
+	if blocks < 2 {
+		return 0
+	} else if blocks > readAheadMax {
+		return readAheadMax
+	}
+	return blocks
+}
+
+// prefetchedBlock is a block decoded in the background.
+type prefetchedBlock struct {
+	kind byte
+	data []byte
+	err  error
+}
+
+// prefetcher reads and decodes blocks from a stream in a background
+// goroutine. Memory is bounded by the number of buffers, one of which is
+// held by the consumer while the others are filled ahead.
+type prefetcher struct {
+	blocks chan prefetchedBlock
+	free   chan []byte
+	quit   chan struct{}
+	done   chan struct{}
+
+	last []byte // buffer held by the consumer
+	held bool
+	err  error
+}
+
+func newPrefetcher(r *bufio.Reader, compress Compression, buffers int) *prefetcher {
+	p := &prefetcher{
+		blocks: make(chan prefetchedBlock, buffers),
+		free:   make(chan []byte, buffers),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < buffers; i++ {
+		p.free <- nil
+	}
+	go p.loop(r, blockReader{compress: compress})
+	return p
+}
+
+// ReadBlock returns the kind and data of the next block. The data is only
+// valid until the next call.
+func (p *prefetcher) ReadBlock() (byte, []byte, error) {
+	if p.err != nil {
+		return 0, nil, p.err
+	}
+
+	if p.held {
+		p.free <- p.last
+		p.last, p.held = nil, false
+	}
+
+	blk, ok := <-p.blocks
+	if !ok {
+		blk.err = io.ErrUnexpectedEOF
+	}
+	if blk.err != nil {
+		p.err = blk.err
+		return 0, nil, blk.err
+	}
+	p.last, p.held = blk.data, true
+	return blk.kind, blk.data, nil
+}
+
+// Close stops the background goroutine and waits for it to exit.
+func (p *prefetcher) Close() {
+	close(p.quit)
+	<-p.done
+	p.last, p.held = nil, false
+}
+
+func (p *prefetcher) loop(r *bufio.Reader, br blockReader) {
+	defer close(p.done)
+	defer close(p.blocks)
+
+	for {
+		select {
+		case br.buf = <-p.free:
+		case <-p.quit:
+			return
+		}
+
+		kind, data, err := br.ReadFrom(r)
+		select {
+		case p.blocks <- prefetchedBlock{kind: kind, data: data, err: err}:
+		case <-p.quit:
+			return
+		}
+
+		// stop after errors or at the end of the data blocks
+		if err != nil || kind != blockKindData {
+			return
+		}
+	}
+}
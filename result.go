@@ -0,0 +1,71 @@
+package extsort
+
+// Result is the sorted output of a Sorter, which can be iterated multiple
+// times. It remains valid until the sorter is closed or reset.
+type Result struct {
+	s    *Sorter
+	ents []memBufferEntry // sorted items, if retained in memory
+	mem  bool
+}
+
+// Result applies the sort algorithm and returns a re-iterable result.
+// Like Sort, it ends ingestion.
+func (s *Sorter) Result() (*Result, error) {
+	if ents, ok := s.sortBuffer(); ok {
+		return &Result{s: s, ents: ents, mem: true}, nil
+	}
+
+	if err := s.finish(); err != nil {
+		return nil, err
+	}
+	return &Result{s: s}, nil
+}
+
+// NewIterator returns a new iterator over the result, merging the
+// temporary runs again. Multiple iterators may be open at the same time.
+func (r *Result) NewIterator() (*Iterator, error) {
+	if r.mem {
+		return newIterator([]section{&memSection{ents: copyEntries(r.ents)}}, r.s.opt)
+	}
+
+	sections, err := r.s.runSections(r.s.opt.BufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return r.s.newIterator(sections)
+}
+
+// Materialize merges the temporary runs into a single run, applying
+// de-duplication, combination and limits, so subsequent iterators only
+// need to scan it. Iterators created before remain valid. It must not be
+// called concurrently with NewIterator.
+func (r *Result) Materialize() error {
+	if r.mem || len(r.s.runs) < 2 {
+		return nil
+	}
+
+	iter, err := r.NewIterator()
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	for iter.Next() {
+		if err := r.s.tw.EncodeKind(iter.ent.kind, iter.Key(), iter.ent.Val()); err != nil {
+			return err
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	if err := iter.Close(); err != nil {
+		return err
+	}
+
+	run, err := r.s.tw.Flush()
+	if err != nil {
+		return err
+	}
+	r.s.runs = append(r.s.runs[:0:0], run)
+	return nil
+}
@@ -0,0 +1,126 @@
+package extsort_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("Result", func() {
+	var workDir string
+
+	readAll := func(r *extsort.Result) ([][2]string, error) {
+		iter, err := r.NewIterator()
+		if err != nil {
+			return nil, err
+		}
+		defer iter.Close()
+
+		var pairs [][2]string
+		for iter.Next() {
+			pairs = append(pairs, [2]string{string(iter.Key()), string(iter.Value())})
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+		return pairs, iter.Close()
+	}
+
+	fill := func(opt extsort.Options, n int) *extsort.Sorter {
+		opt.BufferSize = 64 * 1024
+		opt.WorkDir = workDir
+
+		sorter := extsort.New(&opt)
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("k%05d", (i*7919)%20_000)
+			Expect(sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i%7)))).To(Succeed())
+		}
+		return sorter
+	}
+
+	sortAll := func(opt extsort.Options, n int) [][2]string {
+		sorter := fill(opt, n)
+		defer sorter.Close()
+
+		iter, err := sorter.Sort()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		var pairs [][2]string
+		for iter.Next() {
+			pairs = append(pairs, [2]string{string(iter.Key()), string(iter.Value())})
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		return pairs
+	}
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	iterateTwice := func(opt extsort.Options, n int) {
+		expected := sortAll(opt, n)
+
+		sorter := fill(opt, n)
+		defer sorter.Close()
+
+		result, err := sorter.Result()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(readAll(result)).To(Equal(expected))
+		Expect(readAll(result)).To(Equal(expected))
+
+		Expect(result.Materialize()).To(Succeed())
+		Expect(readAll(result)).To(Equal(expected))
+		Expect(readAll(result)).To(Equal(expected))
+	}
+
+	DescribeTable("iterates multiple times",
+		func(opt extsort.Options) {
+			iterateTwice(opt, 50_000)
+		},
+		optionEntries("default", "stable", "de-duplicated", "combined", "parallel merge", "limited"),
+	)
+
+	It("iterates in-memory results multiple times", func() {
+		iterateTwice(extsort.Options{Limit: 3}, 100)
+	})
+
+	It("iterates empty results multiple times", func() {
+		iterateTwice(extsort.Options{}, 0)
+	})
+
+	It("keeps open iterators valid when materialized", func() {
+		expected := sortAll(extsort.Options{}, 50_000)
+
+		sorter := fill(extsort.Options{}, 50_000)
+		defer sorter.Close()
+
+		result, err := sorter.Result()
+		Expect(err).NotTo(HaveOccurred())
+
+		iter, err := result.NewIterator()
+		Expect(err).NotTo(HaveOccurred())
+		defer iter.Close()
+
+		Expect(result.Materialize()).To(Succeed())
+
+		var pairs [][2]string
+		for iter.Next() {
+			pairs = append(pairs, [2]string{string(iter.Key()), string(iter.Value())})
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		Expect(pairs).To(Equal(expected))
+		Expect(readAll(result)).To(Equal(expected))
+	})
+})
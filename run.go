@@ -0,0 +1,260 @@
+package extsort
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// Errors returned when writing or reading runs and tables.
+var (
+	ErrUnsorted   = errors.New("extsort: items are not in ascending order")
+	ErrInvalidRun = errors.New("extsort: invalid run")
+	ErrCorrupt    = errors.New("extsort: corrupt block")
+)
+
+const (
+	runVersion   = 1
+	runBlockSize = 16 << 10 // 16k
+)
+
+var runMagic = [4]byte{'X', 'S', 'R', 'T'}
+
+// RunWriter writes a sorted run. Runs can be read by a RunReader and merged
+// with other runs using Merge.
+//
+// A run is encoded as follows:
+//
+//	run    := header block* index footer
+//	header := magic:"XSRT" version:uint8 compression:uint8
+//	block  := kind:uint8 uvarint(len(data)) data checksum:uint32
+//	data   := compressed(record*)
+//	record := uvarint(len(suffix)) uvarint(len(prefix)) uvarint(len(value)<<2 | kind) suffix value
+//	index  := block of records, mapping the last key of each data block to
+//	          uvarint(offset) uvarint(size)
+//	footer := offset(index):uint64 size(index):uint64 magic:"XSRT"
+//
+// Blocks are compressed independently and hold approximately 16KiB of
+// records. Keys are delta encoded, each record only stores the suffix that
+// is not shared with the key of the previous record. The first and every
+// 16th record of each block are restart points and store the full key.
+// The kind of a record is 0 for regular values. Tombstones (1) and pointers
+// to values in a value log (2) are only written to the temporary runs of a
+// Sorter and rejected by RunReader.
+type RunWriter struct {
+	bw    *blockFileWriter
+	order orderCheck
+}
+
+// NewRunWriter inits a new run writer, using opt.Compare (and
+// opt.CompareValue, if set) to validate the order and opt.Compression to
+// compress the output.
+func NewRunWriter(w io.Writer, opt *Options) *RunWriter {
+	opt = opt.norm()
+	return &RunWriter{
+		bw:    newRunBlockWriter(w, opt.Compression),
+		order: orderCheck{compare: opt.Compare, compareValue: opt.CompareValue},
+	}
+}
+
+// Put appends a key value pair to the run. Items must be added in
+// ascending order, otherwise ErrUnsorted is returned.
+func (w *RunWriter) Put(key, value []byte) error {
+	if err := w.order.Check(key, value); err != nil {
+		return err
+	}
+	return w.bw.Add(key, value)
+}
+
+// Close completes the run. It does not close the underlying writer.
+func (w *RunWriter) Close() error {
+	return w.bw.Close()
+}
+
+// RunReader reads a run written by a RunWriter. It implements the Source
+// interface.
+type RunReader struct {
+	dec *runDecoder
+	ent *entry
+	err error
+}
+
+// NewRunReader opens a run for reading.
+func NewRunReader(r io.Reader) (*RunReader, error) {
+	dec, err := newRunDecoder(r)
+	if err != nil {
+		return nil, err
+	}
+	return &RunReader{dec: dec}, nil
+}
+
+// Next advances the reader to the next item and returns true if successful.
+func (r *RunReader) Next() bool {
+	if r.err != nil {
+		return false
+	}
+
+	ent, err := r.dec.ReadNext()
+	if err != nil {
+		r.err = err
+	} else if ent != nil && ent.kind != recordValue {
+		// internal records cannot be resolved outside of a Sorter
+		ent.Release()
+		ent, r.err = nil, ErrCorrupt
+	}
+	if r.ent != nil {
+		r.ent.Release()
+	}
+	r.ent = ent
+	return ent != nil
+}
+
+// Key returns the key at the current cursor position.
+func (r *RunReader) Key() []byte {
+	return r.ent.Key()
+}
+
+// Value returns the value at the current cursor position.
+func (r *RunReader) Value() []byte {
+	return r.ent.Val()
+}
+
+// Err returns the error, if occurred.
+func (r *RunReader) Err() error {
+	return r.err
+}
+
+// Close closes the reader. It does not close the underlying reader.
+func (r *RunReader) Close() error {
+	if r.ent != nil {
+		r.ent.Release()
+		r.ent = nil
+	}
+	return r.dec.Close()
+}
+
+// --------------------------------------------------------------------
+
+// orderCheck validates that items are added in ascending order.
+type orderCheck struct {
+	compare      Compare
+	compareValue Compare
+
+	lastKey []byte
+	lastVal []byte
+	started bool
+}
+
+func (o *orderCheck) Check(key, val []byte) error {
+	if o.started {
+		c := o.compare(key, o.lastKey)
+		if c == 0 && o.compareValue != nil {
+			c = o.compareValue(val, o.lastVal)
+		}
+		if c < 0 {
+			return ErrUnsorted
+		}
+	}
+
+	o.started = true
+	o.lastKey = append(o.lastKey[:0], key...)
+	if o.compareValue != nil {
+		o.lastVal = append(o.lastVal[:0], val...)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+func newRunBlockWriter(w io.Writer, compress Compression) *blockFileWriter {
+	bw := newBlockFileWriter(w, runMagic, runVersion, compress, runBlockSize)
+	bw.kinds = true
+	return bw
+}
+
+// runDecoder reads the blocks of a run sequentially.
+type runDecoder struct {
+	r    *bufio.Reader
+	br   blockReader
+	pf   *prefetcher
+	it   blockIter
+	done bool
+}
+
+func newRunDecoder(src io.Reader) (*runDecoder, error) {
+	r := bufio.NewReaderSize(src, 1<<12) // 4k
+
+	var header [blockFileHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrInvalidRun
+		}
+		return nil, err
+	}
+
+	compress, ok := readBlockFileHeader(header[:], runMagic, runVersion)
+	if !ok {
+		return nil, ErrInvalidRun
+	}
+	return &runDecoder{r: r, br: blockReader{compress: compress}, it: blockIter{kinds: true}}, nil
+}
+
+// ReadAhead starts decoding blocks in the background, using the given
+// number of block buffers.
+func (d *runDecoder) ReadAhead(buffers int) {
+	d.pf = newPrefetcher(d.r, d.br.compress, buffers)
+}
+
+// ReadNext returns the next entry or nil at the end of the run.
+func (d *runDecoder) ReadNext() (*entry, error) {
+	for !d.it.Next() {
+		if d.it.err != nil {
+			return nil, d.it.err
+		}
+		if d.done {
+			return nil, nil
+		}
+
+		kind, data, err := d.readBlock()
+		if err != nil {
+			return nil, err
+		}
+
+		switch kind {
+		case blockKindData:
+			d.it.Reset(data)
+		case blockKindIndex:
+			d.it.Reset(nil)
+			d.done = true
+		default:
+			return nil, ErrCorrupt
+		}
+	}
+
+	return d.it.Entry(), nil
+}
+
+func (d *runDecoder) readBlock() (byte, []byte, error) {
+	if d.pf != nil {
+		return d.pf.ReadBlock()
+	}
+	return d.br.ReadFrom(d.r)
+}
+
+func (d *runDecoder) Close() error {
+	if d.pf != nil {
+		d.pf.Close()
+		d.pf = nil
+	}
+	d.it.Reset(nil)
+	d.br.buf = nil
+	d.done = true
+	return nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,190 @@
+package extsort_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("RunWriter/RunReader", func() {
+	writeRun := func(opt *extsort.Options, pairs ...[2]string) ([]byte, error) {
+		buf := new(bytes.Buffer)
+		w := extsort.NewRunWriter(buf, opt)
+		for _, pair := range pairs {
+			if err := w.Put([]byte(pair[0]), []byte(pair[1])); err != nil {
+				return nil, err
+			}
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+
+	readRun := func(data []byte) ([][2]string, error) {
+		r, err := extsort.NewRunReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		var read [][2]string
+		for r.Next() {
+			read = append(read, [2]string{string(r.Key()), string(r.Value())})
+		}
+		if err := r.Err(); err != nil {
+			return nil, err
+		}
+		return read, r.Close()
+	}
+
+	DescribeTable("writes/reads runs",
+		func(c extsort.Compression) {
+			pairs := make([][2]string, 0, 10_000)
+			for i := 0; i < 10_000; i++ {
+				pairs = append(pairs, [2]string{fmt.Sprintf("k%05d", i), fmt.Sprintf("v%d", i)})
+			}
+
+			data, err := writeRun(&extsort.Options{Compression: c}, pairs...)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(data[:6]).To(Equal([]byte{'X', 'S', 'R', 'T', 1, byte(c)}))
+			Expect(data[len(data)-4:]).To(Equal([]byte{'X', 'S', 'R', 'T'}))
+			Expect(readRun(data)).To(Equal(pairs))
+		},
+		Entry("uncompressed", extsort.CompressionNone),
+		Entry("gzip", extsort.CompressionGzip),
+		Entry("snappy", extsort.CompressionSnappy),
+	)
+
+	It("writes/reads blank runs", func() {
+		data, err := writeRun(nil)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(data[:6]).To(Equal([]byte{'X', 'S', 'R', 'T', 1, 0}))
+		Expect(readRun(data)).To(BeEmpty())
+	})
+
+	It("delta encodes keys", func() {
+		data, err := writeRun(nil,
+			[2]string{"https://example.com/a", "v1"},
+			[2]string{"https://example.com/ab", "v2"},
+			[2]string{"https://example.com/b", "v3"},
+			[2]string{"https://example.com/b", "v4"},
+		)
+		Expect(err).NotTo(HaveOccurred())
+		// once in the first record, once in the index
+		Expect(bytes.Count(data, []byte("https://example.com/"))).To(Equal(2))
+		Expect(readRun(data)).To(Equal([][2]string{
+			{"https://example.com/a", "v1"},
+			{"https://example.com/ab", "v2"},
+			{"https://example.com/b", "v3"},
+			{"https://example.com/b", "v4"},
+		}))
+	})
+
+	It("validates order", func() {
+		_, err := writeRun(nil, [2]string{"bar", "v1"}, [2]string{"bar", "v2"}, [2]string{"foo", "v3"})
+		Expect(err).NotTo(HaveOccurred())
+
+		_, err = writeRun(nil, [2]string{"bar", "v1"}, [2]string{"foo", "v2"}, [2]string{"baz", "v3"})
+		Expect(err).To(MatchError(extsort.ErrUnsorted))
+
+		_, err = writeRun(&extsort.Options{CompareValue: bytes.Compare}, [2]string{"bar", "v2"}, [2]string{"bar", "v1"})
+		Expect(err).To(MatchError(extsort.ErrUnsorted))
+	})
+
+	It("rejects invalid input", func() {
+		_, err := readRun([]byte("XSR"))
+		Expect(err).To(MatchError(extsort.ErrInvalidRun))
+
+		_, err = readRun([]byte{'X', 'S', 'R', 'T', 99, 0})
+		Expect(err).To(MatchError(extsort.ErrInvalidRun))
+
+		data, err := writeRun(nil, [2]string{"bar", "v1"}, [2]string{"foo", "v2"})
+		Expect(err).NotTo(HaveOccurred())
+		_, err = readRun(data[:20])
+		Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+
+		data[10] ^= 0xff
+		_, err = readRun(data)
+		Expect(err).To(MatchError(extsort.ErrCorrupt))
+	})
+
+	It("rejects corrupt lengths", func() {
+		blank, err := writeRun(nil)
+		Expect(err).NotTo(HaveOccurred())
+		header := blank[:6]
+
+		// block length exceeds the input
+		data := append(append([]byte{}, header...), 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01)
+		_, err = readRun(data)
+		Expect(err).To(MatchError(extsort.ErrCorrupt))
+
+		// checksummed block with an overflowing key length
+		var rec []byte
+		rec = appendUvarint(rec, math.MaxUint64)
+		rec = append(rec, 0, 0, 'x')
+		data = append(append([]byte{}, header...), frameBlock(0, rec)...)
+		_, err = readRun(data)
+		Expect(err).To(MatchError(extsort.ErrCorrupt))
+	})
+
+	It("rejects internal records", func() {
+		blank, err := writeRun(nil)
+		Expect(err).NotTo(HaveOccurred())
+
+		// a tombstone, as written to the temporary runs of a sorter
+		data := append(append([]byte{}, blank[:6]...), frameBlock(0, []byte{3, 0, 1, 'f', 'o', 'o'})...)
+		data = append(data, blank[6:]...)
+		_, err = readRun(data)
+		Expect(err).To(MatchError(extsort.ErrCorrupt))
+	})
+
+	It("merges runs", func() {
+		run1, err := writeRun(nil, [2]string{"bar", "v1"}, [2]string{"foo", "v2"})
+		Expect(err).NotTo(HaveOccurred())
+		run2, err := writeRun(nil, [2]string{"baz", "v3"}, [2]string{"foo", "v4"})
+		Expect(err).NotTo(HaveOccurred())
+
+		r1, err := extsort.NewRunReader(bytes.NewReader(run1))
+		Expect(err).NotTo(HaveOccurred())
+		defer r1.Close()
+		r2, err := extsort.NewRunReader(bytes.NewReader(run2))
+		Expect(err).NotTo(HaveOccurred())
+		defer r2.Close()
+
+		iter := extsort.Merge(&extsort.Options{Dedupe: bytes.Equal}, r1, r2)
+		defer iter.Close()
+
+		var keys, vals []string
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+			vals = append(vals, string(iter.Value()))
+		}
+		Expect(iter.Err()).NotTo(HaveOccurred())
+		Expect(keys).To(Equal([]string{"bar", "baz", "foo"}))
+		Expect(vals).To(Equal([]string{"v1", "v3", "v4"}))
+	})
+})
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var scratch [binary.MaxVarintLen64]byte
+	return append(dst, scratch[:binary.PutUvarint(scratch[:], v)]...)
+}
+
+// frameBlock frames uncompressed block data.
+func frameBlock(kind byte, data []byte) []byte {
+	b := appendUvarint([]byte{kind}, uint64(len(data)))
+	b = append(b, data...)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return append(b, sum[:]...)
+}
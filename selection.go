@@ -0,0 +1,272 @@
+package extsort
+
+import "container/heap"
+
+// selectionItem is a buffered item, tagged with its run.
+type selectionItem struct {
+	memBufferEntry
+	run int
+}
+
+// selectionHeap is a min-heap view on a memBuffer, ordering items by run
+// and then by the sort order.
+type selectionHeap struct {
+	*memBuffer
+	runs []int
+}
+
+func (h *selectionHeap) Less(i, j int) bool {
+	if h.runs[i] != h.runs[j] {
+		return h.runs[i] < h.runs[j]
+	}
+	return h.memBuffer.Less(i, j)
+}
+
+func (h *selectionHeap) Swap(i, j int) {
+	h.memBuffer.Swap(i, j)
+	h.runs[i], h.runs[j] = h.runs[j], h.runs[i]
+}
+
+func (h *selectionHeap) Push(x interface{}) {
+	item := x.(selectionItem)
+	h.ents = append(h.ents, item.memBufferEntry)
+	h.runs = append(h.runs, item.run)
+	h.size += len(item.data)
+}
+
+func (h *selectionHeap) Pop() interface{} {
+	n := len(h.ents) - 1
+	item := selectionItem{memBufferEntry: h.ents[n], run: h.runs[n]}
+	h.ents[n].entry = nil
+	h.ents = h.ents[:n]
+	h.runs = h.runs[:n]
+	h.size -= len(item.data)
+	return item
+}
+
+// selector generates runs by replacement selection.
+type selector struct {
+	heap selectionHeap
+	run  int // run currently written
+
+	// last item written to the current run
+	lastKey, lastVal []byte
+	started          bool
+
+	// pending item, not yet encoded
+	cur *entry
+	val []byte
+
+	// most recent tombstone of the current run
+	tomb    []byte
+	tombSeq int
+	shadow  bool
+}
+
+// putSelect emits the smallest items until the new item fits the buffer.
+// The new item is assigned to the current run if it does not sort before
+// the last written item, otherwise to the next. Tombstones, and items added
+// after tombstones, are assigned to the next run unless their key sorts
+// after the last written item.
+func (s *Sorter) putSelect(kind recordKind, key, value []byte) error {
+	if sz := s.buf.ByteSize(); sz > 0 && sz+len(key)+len(value) > s.opt.BufferSize {
+		for ; sz > 0 && sz+len(key)+len(value) > s.opt.BufferSize; sz = s.buf.ByteSize() {
+			if err := s.selectNext(); err != nil {
+				return err
+			}
+		}
+		if err := s.scheduleCompaction(); err != nil {
+			return err
+		}
+	}
+
+	run := s.sel.run
+	if s.sel.started {
+		c := s.opt.Compare(key, s.sel.lastKey)
+		switch {
+		case c < 0:
+			run++
+		case c == 0 && (kind == recordDeleted || s.buf.deletes):
+			// a tombstone for the last written key may have been assigned
+			// to the next run, it must not shadow items added later
+			run++
+		case kind != recordDeleted && !s.opt.follows(key, value, s.sel.lastKey, s.sel.lastVal):
+			run++
+		}
+	}
+
+	s.buf.AppendKind(kind, key, value)
+	s.sel.heap.runs = append(s.sel.heap.runs, run)
+	heap.Fix(&s.sel.heap, len(s.sel.heap.runs)-1)
+	return nil
+}
+
+// selectNext writes the smallest item, starting a new run if required.
+func (s *Sorter) selectNext() error {
+	if err := s.openTemp(); err != nil {
+		return err
+	}
+
+	item := heap.Pop(&s.sel.heap).(selectionItem)
+	if item.run != s.sel.run {
+		if err := s.finishRun(); err != nil {
+			item.Release()
+			return err
+		}
+		s.sel.run = item.run
+		s.sel.shadow = false
+	}
+
+	// drop items shadowed by a tombstone of the current run
+	if s.shadowed(item.memBufferEntry) {
+		item.Release()
+		return nil
+	}
+
+	s.sel.lastKey = append(s.sel.lastKey[:0], item.Key()...)
+	s.sel.lastVal = append(s.sel.lastVal[:0], item.Val()...)
+	s.sel.started = true
+
+	if item.Deleted() {
+		s.sel.tomb = append(s.sel.tomb[:0], item.Key()...)
+		s.sel.tombSeq = item.i
+		s.sel.shadow = true
+		return s.emitDeleted(item.entry)
+	}
+	return s.emit(item.entry)
+}
+
+// shadowed returns true if the item was added before the most recent
+// tombstone with an equal key. Tombstones sort first among equal keys, so
+// subsequent tombstones only update the tombstone sequence.
+func (s *Sorter) shadowed(item memBufferEntry) bool {
+	if !s.sel.shadow {
+		return false
+	}
+	if s.opt.Compare(item.Key(), s.sel.tomb) != 0 {
+		s.sel.shadow = false
+		return false
+	}
+
+	if item.Deleted() {
+		if item.i > s.sel.tombSeq {
+			s.sel.tombSeq = item.i
+		}
+		return true
+	}
+	return item.i < s.sel.tombSeq
+}
+
+// emitDeleted encodes the pending item and the tombstone ent, unless no older
+// runs exist.
+func (s *Sorter) emitDeleted(ent *entry) error {
+	defer ent.Release()
+
+	if err := s.encodePending(); err != nil {
+		return err
+	}
+	if len(s.runs) == 0 {
+		return nil
+	}
+	return s.tw.EncodeKind(recordDeleted, ent.Key(), nil)
+}
+
+// emit de-duplicates or combines ent with the pending item and encodes the
+// pending item once complete.
+func (s *Sorter) emit(ent *entry) error {
+	if cur := s.sel.cur; cur != nil && s.equal != nil && s.equal(ent.Key(), cur.Key()) {
+		switch {
+		case s.opt.Combine != nil:
+			s.sel.val = s.opt.combineSorted(cur.Key(), s.sel.val, ent.Val())
+			ent.Release()
+		case s.opt.DedupePolicy == DedupeError:
+			ent.Release()
+			return &DuplicateKeyError{Key: append([]byte(nil), cur.Key()...)}
+		case s.opt.keepTail():
+			cur.Release()
+			s.sel.cur, s.sel.val = ent, ent.Val()
+		default:
+			ent.Release()
+		}
+		return nil
+	}
+
+	if err := s.encodePending(); err != nil {
+		ent.Release()
+		return err
+	}
+	s.sel.cur, s.sel.val = ent, ent.Val()
+	return nil
+}
+
+func (s *Sorter) encodePending() error {
+	cur := s.sel.cur
+	if cur == nil {
+		return nil
+	}
+
+	err := s.tw.EncodeKind(cur.kind, cur.Key(), s.sel.val)
+	cur.Release()
+	s.sel.cur, s.sel.val = nil, nil
+	return err
+}
+
+// splitRun completes the current run early, so it can be read, and assigns
+// all buffered items to the next run. Buffered items with keys equal to the
+// last written item are written first, depending on the tie order they are
+// older or newer than it.
+func (s *Sorter) splitRun() error {
+	for len(s.sel.heap.runs) != 0 && s.sel.heap.runs[0] == s.sel.run && s.opt.Compare(s.buf.ents[0].Key(), s.sel.lastKey) == 0 {
+		if err := s.selectNext(); err != nil {
+			return err
+		}
+	}
+	if err := s.finishRun(); err != nil {
+		return err
+	}
+
+	// equal keys are assigned to runs in insertion order, so items of the
+	// current and the next run can be merged into one
+	s.sel.run++
+	s.sel.shadow = false
+	for i := range s.sel.heap.runs {
+		s.sel.heap.runs[i] = s.sel.run
+	}
+	heap.Init(&s.sel.heap)
+	return nil
+}
+
+// finishRun completes the current run.
+func (s *Sorter) finishRun() error {
+	if err := s.encodePending(); err != nil {
+		return err
+	}
+
+	run, err := s.tw.Flush()
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, run)
+	s.sel.started = false
+	return nil
+}
+
+// flushSelect writes all buffered items.
+func (s *Sorter) flushSelect() error {
+	if err := s.openTemp(); err != nil {
+		return err
+	}
+
+	for len(s.sel.heap.runs) != 0 {
+		if err := s.selectNext(); err != nil {
+			return err
+		}
+	}
+	if s.sel.started || len(s.runs) == 0 {
+		if err := s.finishRun(); err != nil {
+			return err
+		}
+	}
+	s.sel.run++
+	return nil
+}
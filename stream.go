@@ -0,0 +1,363 @@
+package extsort
+
+import (
+	"container/heap"
+	"errors"
+)
+
+// Errors returned by stream sorters.
+var (
+	ErrLate     = errors.New("extsort: item exceeds the declared disorder")
+	ErrFinished = errors.New("extsort: stream is finished")
+)
+
+// Disorder bounds how far items of a stream are out of order. Items are
+// emitted once either bound is met.
+type Disorder struct {
+	// Window is the max number of items by which an item can be delayed.
+	// Items are emitted once more than Window items are buffered.
+	Window int
+
+	// Watermark returns a key for the most recently added key, such that no
+	// item added later sorts before it. Items with keys below the highest
+	// watermark are emitted.
+	Watermark func(key []byte) []byte
+}
+
+// StreamSorter sorts a stream of items with bounded disorder and emits them
+// as soon as they can no longer be preceded by other items. Items are
+// buffered in memory and only spilled to disk if the buffer exceeds the
+// BufferSize.
+//
+// Items with equal keys are only de-duplicated or combined if buffered
+// together; equal items that arrive after an item has been emitted are
+// rejected with ErrLate. Without Dedupe and Combine, items equal to the last
+// emitted item are accepted and emitted after it. Options.Limit and
+// Options.Sort are ignored.
+type StreamSorter struct {
+	opt   *Options
+	dis   Disorder
+	equal Equal
+
+	buf   *memBuffer
+	tw    *tempWriter
+	runs  []section
+	disk  *minHeap
+	count int // number of buffered items
+
+	watermark []byte
+	marked    bool
+	finished  bool
+
+	ent              *entry
+	lastKey, lastVal []byte
+	emitted          bool
+	err              error
+}
+
+// NewStream inits a streaming sorter.
+func NewStream(dis Disorder, opt *Options) *StreamSorter {
+	opt = opt.norm()
+	return &StreamSorter{
+		opt:   opt,
+		dis:   dis,
+		equal: opt.keyEqual(),
+		buf:   newMemBuffer(opt, false),
+		disk:  &minHeap{compare: opt.Compare, compareValue: opt.CompareValue, stable: opt.Stable},
+	}
+}
+
+// Append appends a data chunk to the stream.
+func (s *StreamSorter) Append(data []byte) error {
+	return s.Put(data, nil)
+}
+
+// Put adds a key value pair to the stream. It returns ErrLate if the item
+// sorts before an already emitted item and ErrFinished after Finish.
+func (s *StreamSorter) Put(key, value []byte) error {
+	if s.err != nil {
+		return s.err
+	}
+	if s.finished {
+		return ErrFinished
+	}
+	if s.emitted && s.late(key, value) {
+		return ErrLate
+	}
+
+	if sz := s.buf.ByteSize(); sz > 0 && sz+len(key)+len(value) > s.opt.BufferSize {
+		if err := s.spill(); err != nil {
+			s.err = err
+			return err
+		}
+	}
+
+	s.buf.Append(key, value)
+	heap.Fix(streamHeap{s.buf}, len(s.buf.ents)-1)
+	s.count++
+
+	if s.dis.Watermark != nil {
+		if mark := s.dis.Watermark(key); !s.marked || s.opt.Compare(mark, s.watermark) > 0 {
+			s.watermark = append(s.watermark[:0], mark...)
+			s.marked = true
+		}
+	}
+	return nil
+}
+
+// late returns true if an item sorts before the last emitted item or would
+// need to be de-duplicated or combined with it.
+func (s *StreamSorter) late(key, value []byte) bool {
+	if s.equal != nil {
+		return !s.opt.follows(key, value, s.lastKey, s.lastVal) || s.equal(key, s.lastKey)
+	}
+
+	c := s.opt.Compare(key, s.lastKey)
+	if c == 0 && s.opt.CompareValue != nil {
+		c = s.opt.CompareValue(value, s.lastVal)
+	}
+	return c < 0
+}
+
+// Finish marks the end of the stream. All remaining items can be emitted,
+// no more items can be added.
+func (s *StreamSorter) Finish() {
+	s.finished = true
+}
+
+// Next advances to the next item that is ready to be emitted and returns
+// true if successful. Next returns false if no item is ready yet; further
+// items may be emitted after adding more items or after calling Finish.
+func (s *StreamSorter) Next() bool {
+	if s.ent != nil {
+		s.ent.Release()
+		s.ent = nil
+	}
+	if s.err != nil {
+		return false
+	}
+
+	key, ok := s.peek()
+	if !ok || !s.ready(key) {
+		return false
+	}
+
+	ent, err := s.pop()
+	if err != nil {
+		s.err = err
+		return false
+	}
+	if s.equal != nil {
+		if ent, err = s.reduce(ent); err != nil {
+			s.err = err
+			return false
+		}
+	}
+
+	s.ent = ent
+	s.lastKey = append(s.lastKey[:0], ent.Key()...)
+	s.lastVal = append(s.lastVal[:0], ent.Val()...)
+	s.emitted = true
+	return true
+}
+
+// Key returns the key at the current cursor position.
+func (s *StreamSorter) Key() []byte {
+	return s.ent.Key()
+}
+
+// Value returns the value at the current cursor position.
+func (s *StreamSorter) Value() []byte {
+	return s.ent.Val()
+}
+
+// Err returns the error, if occurred.
+func (s *StreamSorter) Err() error {
+	return s.err
+}
+
+// Close releases all buffered items and removes temporary files.
+func (s *StreamSorter) Close() (err error) {
+	if s.ent != nil {
+		s.ent.Release()
+		s.ent = nil
+	}
+	s.buf.Free()
+	for s.disk.Len() != 0 {
+		_, ent := s.disk.PopEntry()
+		ent.Release()
+	}
+	for _, sec := range s.runs {
+		if e := sec.Close(); e != nil {
+			err = e
+		}
+	}
+	s.runs = nil
+
+	if s.tw != nil {
+		if e := s.tw.Close(); e != nil {
+			err = e
+		}
+		s.tw = nil
+	}
+	return
+}
+
+// ready returns true if an item with the given key can be emitted.
+func (s *StreamSorter) ready(key []byte) bool {
+	switch {
+	case s.finished:
+		return true
+	case s.dis.Window > 0 && s.count > s.dis.Window:
+		return true
+	case s.marked && s.opt.Compare(key, s.watermark) < 0:
+		return true
+	}
+	return false
+}
+
+// memFirst returns true if the next item is buffered in memory rather than
+// spilled to disk.
+func (s *StreamSorter) memFirst() bool {
+	if s.disk.Len() == 0 {
+		return true
+	} else if len(s.buf.ents) == 0 {
+		return false
+	}
+
+	// items in memory were added after spilled items
+	mem, disk := s.buf.ents[0], s.disk.items[0]
+	return !s.opt.follows(mem.Key(), mem.Val(), disk.Key(), disk.Val())
+}
+
+// peek returns the key of the next item.
+func (s *StreamSorter) peek() ([]byte, bool) {
+	if s.count == 0 {
+		return nil, false
+	}
+	if s.memFirst() {
+		return s.buf.ents[0].Key(), true
+	}
+	return s.disk.items[0].Key(), true
+}
+
+// pop removes and returns the next item.
+func (s *StreamSorter) pop() (*entry, error) {
+	s.count--
+	if s.memFirst() {
+		return heap.Pop(streamHeap{s.buf}).(memBufferEntry).entry, nil
+	}
+
+	section, ent := s.disk.PopEntry()
+	next, err := s.runs[section].ReadNext()
+	if err != nil {
+		ent.Release()
+		return nil, err
+	}
+	if next != nil {
+		s.disk.PushEntry(section, next)
+	}
+	return ent, nil
+}
+
+// reduce de-duplicates or combines ent with all buffered items with equal
+// keys.
+func (s *StreamSorter) reduce(ent *entry) (*entry, error) {
+	for {
+		key, ok := s.peek()
+		if !ok || !s.equal(key, ent.Key()) {
+			return ent, nil
+		}
+
+		next, err := s.pop()
+		if err != nil {
+			ent.Release()
+			return nil, err
+		}
+
+		switch {
+		case s.opt.Combine != nil:
+			key := ent.Key()
+			val := s.opt.combineSorted(key, ent.Val(), next.Val())
+			merged := fetchEntry(len(key), len(val))
+			n := copy(merged.data, key)
+			copy(merged.data[n:], val)
+
+			next.Release()
+			ent.Release()
+			ent = merged
+		case s.opt.DedupePolicy == DedupeError:
+			err := &DuplicateKeyError{Key: append([]byte(nil), next.Key()...)}
+			next.Release()
+			ent.Release()
+			return nil, err
+		case s.opt.keepTail():
+			ent.Release()
+			ent = next
+		default:
+			next.Release()
+		}
+	}
+}
+
+// spill writes the memory buffer to a run on disk.
+func (s *StreamSorter) spill() error {
+	if s.tw == nil {
+		tw, err := newTempWriter(s.opt.WorkDir, s.opt.Compression, s.opt.KeepFiles)
+		if err != nil {
+			return err
+		}
+		s.tw = tw
+	}
+
+	for len(s.buf.ents) != 0 {
+		ent := heap.Pop(streamHeap{s.buf}).(memBufferEntry)
+		err := s.tw.Encode(ent.Key(), ent.Val())
+		ent.Release()
+		if err != nil {
+			return err
+		}
+	}
+	s.buf.Reset()
+
+	run, err := s.tw.Flush()
+	if err != nil {
+		return err
+	}
+	sections, err := newTempReaders([]tempRun{run}, 0)
+	if err != nil {
+		return err
+	}
+
+	section := len(s.runs)
+	s.runs = append(s.runs, sections[0])
+
+	ent, err := sections[0].ReadNext()
+	if err != nil {
+		return err
+	}
+	if ent != nil {
+		s.disk.PushEntry(section, ent)
+	}
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+// streamHeap is a min-heap view on a memBuffer.
+type streamHeap struct{ *memBuffer }
+
+func (h streamHeap) Push(x interface{}) {
+	e := x.(memBufferEntry)
+	h.ents = append(h.ents, e)
+	h.size += len(e.data)
+}
+
+func (h streamHeap) Pop() interface{} {
+	n := len(h.ents)
+	e := h.ents[n-1]
+	h.ents[n-1].entry = nil
+	h.ents = h.ents[:n-1]
+	h.size -= len(e.data)
+	return e
+}
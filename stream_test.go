@@ -0,0 +1,192 @@
+package extsort_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("StreamSorter", func() {
+	var workDir string
+
+	// drain reads all items that are ready
+	drain := func(s *extsort.StreamSorter) [][2]string {
+		var read [][2]string
+		for s.Next() {
+			read = append(read, [2]string{string(s.Key()), string(s.Value())})
+		}
+		return read
+	}
+
+	// shuffled returns n keys, shuffled within blocks of the given size
+	shuffled := func(n, block int) []string {
+		keys := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			j := i/block*block + (i*7919)%block
+			keys = append(keys, fmt.Sprintf("%08d", j))
+		}
+		return keys
+	}
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	It("emits items within a window", func() {
+		subject := extsort.NewStream(extsort.Disorder{Window: 10}, &extsort.Options{WorkDir: workDir})
+		defer subject.Close()
+
+		var read [][2]string
+		var maxBuffered int
+		for i, key := range shuffled(10_000, 10) {
+			Expect(subject.Put([]byte(key), nil)).To(Succeed())
+			read = append(read, drain(subject)...)
+			if n := i + 1 - len(read); n > maxBuffered {
+				maxBuffered = n
+			}
+		}
+		Expect(maxBuffered).To(Equal(10))
+
+		subject.Finish()
+		read = append(read, drain(subject)...)
+		Expect(subject.Err()).NotTo(HaveOccurred())
+		Expect(read).To(HaveLen(10_000))
+		for i, pair := range read {
+			Expect(pair[0]).To(Equal(fmt.Sprintf("%08d", i)))
+		}
+	})
+
+	It("emits items below the watermark", func() {
+		watermark := func(key []byte) []byte {
+			n, _ := strconv.Atoi(string(key))
+			return []byte(fmt.Sprintf("%08d", n-20))
+		}
+		subject := extsort.NewStream(extsort.Disorder{Watermark: watermark}, &extsort.Options{WorkDir: workDir})
+		defer subject.Close()
+
+		Expect(subject.Append([]byte("00000105"))).To(Succeed())
+		Expect(subject.Append([]byte("00000100"))).To(Succeed())
+		Expect(subject.Append([]byte("00000110"))).To(Succeed())
+		Expect(drain(subject)).To(BeEmpty())
+
+		Expect(subject.Append([]byte("00000122"))).To(Succeed())
+		Expect(drain(subject)).To(Equal([][2]string{{"00000100", ""}}))
+
+		Expect(subject.Append([]byte("00000115"))).To(Succeed())
+		Expect(subject.Append([]byte("00000140"))).To(Succeed())
+		Expect(drain(subject)).To(Equal([][2]string{{"00000105", ""}, {"00000110", ""}, {"00000115", ""}}))
+
+		subject.Finish()
+		Expect(drain(subject)).To(Equal([][2]string{{"00000122", ""}, {"00000140", ""}}))
+		Expect(subject.Err()).NotTo(HaveOccurred())
+	})
+
+	It("spills to disk", func() {
+		subject := extsort.NewStream(extsort.Disorder{Window: 20_000}, &extsort.Options{
+			BufferSize: 64 * 1024,
+			WorkDir:    workDir,
+			KeepFiles:  true,
+		})
+		defer subject.Close()
+
+		val := bytes.Repeat([]byte{'x'}, 100)
+		var read [][2]string
+		for _, key := range shuffled(50_000, 10_000) {
+			Expect(subject.Put([]byte(key), val)).To(Succeed())
+			read = append(read, drain(subject)...)
+		}
+		Expect(read).To(HaveLen(30_000))
+		Expect(filepath.Glob(workDir + "/*")).To(HaveLen(1))
+
+		subject.Finish()
+		read = append(read, drain(subject)...)
+		Expect(subject.Err()).NotTo(HaveOccurred())
+		Expect(read).To(HaveLen(50_000))
+		for i, pair := range read {
+			Expect(pair[0]).To(Equal(fmt.Sprintf("%08d", i)))
+		}
+
+		Expect(subject.Close()).To(Succeed())
+		Expect(filepath.Glob(workDir + "/*")).To(BeEmpty())
+	})
+
+	It("de-duplicates buffered items", func() {
+		subject := extsort.NewStream(extsort.Disorder{Window: 3}, &extsort.Options{Dedupe: bytes.Equal})
+		defer subject.Close()
+
+		Expect(subject.Put([]byte("bar"), []byte("v1"))).To(Succeed())
+		Expect(subject.Put([]byte("foo"), []byte("v2"))).To(Succeed())
+		Expect(subject.Put([]byte("bar"), []byte("v3"))).To(Succeed())
+		Expect(drain(subject)).To(BeEmpty())
+
+		Expect(subject.Put([]byte("foo"), []byte("v4"))).To(Succeed())
+		Expect(drain(subject)).To(Equal([][2]string{{"bar", "v3"}}))
+		Expect(subject.Put([]byte("bar"), []byte("v5"))).To(MatchError(extsort.ErrLate))
+
+		subject.Finish()
+		Expect(drain(subject)).To(Equal([][2]string{{"foo", "v4"}}))
+	})
+
+	It("rejects items after finish", func() {
+		subject := extsort.NewStream(extsort.Disorder{Window: 2}, nil)
+		defer subject.Close()
+
+		Expect(subject.Append([]byte("a"))).To(Succeed())
+		subject.Finish()
+		Expect(subject.Append([]byte("b"))).To(MatchError(extsort.ErrFinished))
+		Expect(drain(subject)).To(Equal([][2]string{{"a", ""}}))
+		Expect(subject.Err()).NotTo(HaveOccurred())
+	})
+
+	It("rejects late items", func() {
+		subject := extsort.NewStream(extsort.Disorder{Window: 2}, nil)
+		defer subject.Close()
+
+		Expect(subject.Append([]byte("c"))).To(Succeed())
+		Expect(subject.Append([]byte("d"))).To(Succeed())
+		Expect(subject.Append([]byte("e"))).To(Succeed())
+		Expect(drain(subject)).To(Equal([][2]string{{"c", ""}}))
+
+		Expect(subject.Append([]byte("a"))).To(MatchError(extsort.ErrLate))
+		Expect(subject.Append([]byte("bz"))).To(MatchError(extsort.ErrLate))
+		Expect(subject.Append([]byte("cc"))).To(Succeed())
+	})
+
+	It("accepts keys equal to emitted items", func() {
+		subject := extsort.NewStream(extsort.Disorder{Window: 1}, &extsort.Options{WorkDir: workDir})
+		defer subject.Close()
+
+		Expect(subject.Put([]byte("a"), []byte("v1"))).To(Succeed())
+		Expect(subject.Put([]byte("b"), []byte("v2"))).To(Succeed())
+		Expect(drain(subject)).To(Equal([][2]string{{"a", "v1"}}))
+
+		Expect(subject.Put([]byte("b"), []byte("v3"))).To(Succeed())
+		read := drain(subject)
+		Expect(read).To(HaveLen(1))
+
+		Expect(subject.Put([]byte("b"), []byte("v4"))).To(Succeed())
+		Expect(subject.Put([]byte("a"), []byte("v5"))).To(MatchError(extsort.ErrLate))
+		Expect(subject.Put([]byte("c"), []byte("v6"))).To(Succeed())
+
+		subject.Finish()
+		read = append(read, drain(subject)...)
+		Expect(subject.Err()).NotTo(HaveOccurred())
+		Expect(read[:3]).To(ConsistOf([2]string{"b", "v2"}, [2]string{"b", "v3"}, [2]string{"b", "v4"}))
+		Expect(read[3:]).To(Equal([][2]string{{"c", "v6"}}))
+	})
+
+})
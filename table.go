@@ -0,0 +1,276 @@
+package extsort
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Errors returned by tables.
+var (
+	ErrNotFound     = errors.New("extsort: not found")
+	ErrInvalidTable = errors.New("extsort: invalid table")
+)
+
+const (
+	tableVersion   = 1
+	tableBlockSize = 4 << 10 // 4k
+)
+
+var tableMagic = [4]byte{'X', 'S', 'T', 'B'}
+
+// TableWriter writes sorted items into an immutable, indexed table, which
+// can be opened with OpenTable.
+//
+// A table is encoded as follows:
+//
+//	table  := header block* index footer
+//	header := magic:"XSTB" version:uint8 compression:uint8
+//	block  := kind:uint8 uvarint(len(data)) data checksum:uint32
+//	data   := compressed(record*)
+//	record := uvarint(len(suffix)) uvarint(len(prefix)) uvarint(len(value)) suffix value
+//	index  := block of records, mapping the last key of each data block to
+//	          uvarint(offset) uvarint(size)
+//	footer := offset(index):uint64 size(index):uint64 magic:"XSTB"
+//
+// Keys are delta encoded, each record only stores the suffix that is not
+// shared with the key of the previous record. The first and every 16th
+// record of each block are restart points and store the full key.
+type TableWriter struct {
+	bw    *blockFileWriter
+	order orderCheck
+}
+
+// NewTableWriter inits a new table writer, using opt.Compare (and
+// opt.CompareValue, if set) to validate the order and opt.Compression to
+// compress blocks.
+func NewTableWriter(w io.Writer, opt *Options) *TableWriter {
+	opt = opt.norm()
+	return &TableWriter{
+		bw:    newBlockFileWriter(w, tableMagic, tableVersion, opt.Compression, tableBlockSize),
+		order: orderCheck{compare: opt.Compare, compareValue: opt.CompareValue},
+	}
+}
+
+// Put appends a key value pair to the table. Items must be added in
+// ascending order, otherwise ErrUnsorted is returned.
+func (w *TableWriter) Put(key, value []byte) error {
+	if err := w.order.Check(key, value); err != nil {
+		return err
+	}
+	return w.bw.Add(key, value)
+}
+
+// Close writes the index and completes the table. It does not close the
+// underlying writer.
+func (w *TableWriter) Close() error {
+	return w.bw.Close()
+}
+
+// WriteTable writes all items of src (e.g. an Iterator) to a new table at
+// path.
+func WriteTable(path string, src Source, opt *Options) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	tw := NewTableWriter(f, opt)
+	for src.Next() {
+		if err := tw.Put(src.Key(), src.Value()); err != nil {
+			return err
+		}
+	}
+	if err := src.Err(); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// --------------------------------------------------------------------
+
+// Table is an immutable, indexed table of sorted items.
+type Table struct {
+	f       *os.File
+	compare Compare
+	index   []blockHandle
+
+	mu sync.Mutex
+	br blockReader
+}
+
+// OpenTable opens a table for reading. Only opt.Compare is used, it must
+// match the order of the table.
+func OpenTable(path string, opt *Options) (*Table, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := openTable(f, opt.norm())
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return t, nil
+}
+
+func openTable(f *os.File, opt *Options) (*Table, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	compress, index, ok, err := readBlockFileIndex(f, info.Size(), tableMagic, tableVersion)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		return nil, ErrInvalidTable
+	}
+	return &Table{f: f, compare: opt.Compare, index: index, br: blockReader{compress: compress}}, nil
+}
+
+// Get returns the value of the first item with the given key or
+// ErrNotFound.
+func (t *Table) Get(key []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bi := t.search(key)
+	if bi == len(t.index) {
+		return nil, ErrNotFound
+	}
+
+	var it blockIter
+	if err := t.readBlock(&t.br, &it, bi); err != nil {
+		return nil, err
+	}
+	for it.Next() {
+		if c := t.compare(it.key, key); c == 0 {
+			return append([]byte(nil), it.val...), nil
+		} else if c > 0 {
+			break
+		}
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	return nil, ErrNotFound
+}
+
+// NewIterator returns an iterator over all items of the table.
+func (t *Table) NewIterator() *TableIterator {
+	return &TableIterator{t: t, br: blockReader{compress: t.br.compress}}
+}
+
+// Close closes the table.
+func (t *Table) Close() error {
+	return t.f.Close()
+}
+
+// search returns the index of the first block that may contain key.
+func (t *Table) search(key []byte) int {
+	return sort.Search(len(t.index), func(i int) bool {
+		return t.compare(t.index[i].lastKey, key) >= 0
+	})
+}
+
+func (t *Table) readBlock(br *blockReader, it *blockIter, bi int) error {
+	h := t.index[bi]
+	kind, data, err := br.ReadAt(t.f, h.offset, h.size)
+	if err != nil {
+		return err
+	} else if kind != blockKindData {
+		return ErrCorrupt
+	}
+	it.Reset(data)
+	return nil
+}
+
+// --------------------------------------------------------------------
+
+// TableIterator iterates over the items of a table. It implements the
+// Source interface.
+type TableIterator struct {
+	t  *Table
+	br blockReader
+	it blockIter
+	bi int // next block
+
+	err error
+}
+
+// Next advances the iterator to the next item and returns true if
+// successful.
+func (i *TableIterator) Next() bool {
+	if i.err != nil {
+		return false
+	}
+
+	for !i.it.Next() {
+		if i.it.err != nil {
+			i.err = i.it.err
+			return false
+		}
+		if i.bi >= len(i.t.index) {
+			return false
+		}
+		if err := i.t.readBlock(&i.br, &i.it, i.bi); err != nil {
+			i.err = err
+			return false
+		}
+		i.bi++
+	}
+	return true
+}
+
+// Seek positions the iterator at the first item with a key greater or
+// equal to key and returns true if such an item exists. A subsequent call
+// to Next advances past this item.
+func (i *TableIterator) Seek(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+
+	bi := i.t.search(key)
+	if bi == len(i.t.index) {
+		i.bi = bi
+		i.it.Reset(nil)
+		return false
+	}
+
+	if err := i.t.readBlock(&i.br, &i.it, bi); err != nil {
+		i.err = err
+		return false
+	}
+	i.bi = bi + 1
+
+	for i.it.Next() {
+		if i.t.compare(i.it.key, key) >= 0 {
+			return true
+		}
+	}
+	i.err = i.it.err
+	return false
+}
+
+// Key returns the key at the current cursor position.
+func (i *TableIterator) Key() []byte {
+	return i.it.key
+}
+
+// Value returns the value at the current cursor position.
+func (i *TableIterator) Value() []byte {
+	return i.it.val
+}
+
+// Err returns the error, if occurred.
+func (i *TableIterator) Err() error {
+	return i.err
+}
@@ -0,0 +1,170 @@
+package extsort_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/bsm/extsort"
+
+	. "github.com/bsm/ginkgo/v2"
+	. "github.com/bsm/gomega"
+)
+
+var _ = Describe("Table", func() {
+	var workDir, path string
+
+	writeTable := func(opt *extsort.Options, n int) error {
+		sorter := extsort.New(opt)
+		defer sorter.Close()
+
+		for i := 0; i < n; i++ {
+			key := fmt.Sprintf("k%06d", (i*7919)%n*2)
+			if err := sorter.Put([]byte(key), []byte(fmt.Sprintf("v%d", i))); err != nil {
+				return err
+			}
+		}
+
+		iter, err := sorter.Sort()
+		if err != nil {
+			return err
+		}
+		defer iter.Close()
+
+		return extsort.WriteTable(path, iter, opt)
+	}
+
+	BeforeEach(func() {
+		var err error
+		workDir, err = ioutil.TempDir("", "extsort-test")
+		Expect(err).NotTo(HaveOccurred())
+		path = filepath.Join(workDir, "table")
+	})
+
+	AfterEach(func() {
+		Expect(os.RemoveAll(workDir)).To(Succeed())
+	})
+
+	DescribeTable("writes/reads tables",
+		func(c extsort.Compression) {
+			opt := &extsort.Options{BufferSize: 64 * 1024, WorkDir: workDir, Compression: c}
+			Expect(writeTable(opt, 10_000)).To(Succeed())
+
+			table, err := extsort.OpenTable(path, opt)
+			Expect(err).NotTo(HaveOccurred())
+			defer table.Close()
+
+			Expect(table.Get([]byte("k000000"))).To(Equal([]byte("v0")))
+			Expect(table.Get([]byte("k000002"))).To(Equal([]byte("v7679")))
+			Expect(table.Get([]byte("k019998"))).To(Equal([]byte("v2321")))
+			_, err = table.Get([]byte("k000001"))
+			Expect(err).To(MatchError(extsort.ErrNotFound))
+			_, err = table.Get([]byte("k999999"))
+			Expect(err).To(MatchError(extsort.ErrNotFound))
+
+			iter := table.NewIterator()
+			var n int
+			var prev []byte
+			for iter.Next() {
+				Expect(bytes.Compare(prev, iter.Key())).To(Equal(-1))
+				prev = append(prev[:0], iter.Key()...)
+				n++
+			}
+			Expect(iter.Err()).NotTo(HaveOccurred())
+			Expect(n).To(Equal(10_000))
+		},
+		Entry("uncompressed", extsort.CompressionNone),
+		Entry("gzip", extsort.CompressionGzip),
+		Entry("snappy", extsort.CompressionSnappy),
+	)
+
+	It("seeks", func() {
+		Expect(writeTable(&extsort.Options{WorkDir: workDir}, 10_000)).To(Succeed())
+
+		table, err := extsort.OpenTable(path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer table.Close()
+
+		iter := table.NewIterator()
+		Expect(iter.Seek([]byte("k001233"))).To(BeTrue())
+		Expect(string(iter.Key())).To(Equal("k001234"))
+		Expect(iter.Next()).To(BeTrue())
+		Expect(string(iter.Key())).To(Equal("k001236"))
+
+		Expect(iter.Seek([]byte("k000000"))).To(BeTrue())
+		Expect(string(iter.Key())).To(Equal("k000000"))
+
+		Expect(iter.Seek([]byte("k019998"))).To(BeTrue())
+		Expect(iter.Next()).To(BeFalse())
+
+		Expect(iter.Seek([]byte("k019999"))).To(BeFalse())
+		Expect(iter.Next()).To(BeFalse())
+		Expect(iter.Err()).NotTo(HaveOccurred())
+	})
+
+	It("writes/reads blank tables", func() {
+		Expect(writeTable(nil, 0)).To(Succeed())
+
+		table, err := extsort.OpenTable(path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer table.Close()
+
+		_, err = table.Get([]byte("foo"))
+		Expect(err).To(MatchError(extsort.ErrNotFound))
+		Expect(table.NewIterator().Next()).To(BeFalse())
+	})
+
+	It("validates order", func() {
+		tw := extsort.NewTableWriter(new(bytes.Buffer), nil)
+		Expect(tw.Put([]byte("foo"), nil)).To(Succeed())
+		Expect(tw.Put([]byte("bar"), nil)).To(MatchError(extsort.ErrUnsorted))
+	})
+
+	It("rejects invalid tables", func() {
+		Expect(ioutil.WriteFile(path, []byte("not a table at all, sorry"), 0o644)).To(Succeed())
+		_, err := extsort.OpenTable(path, nil)
+		Expect(err).To(MatchError(extsort.ErrInvalidTable))
+	})
+
+	It("rejects corrupt block handles", func() {
+		Expect(writeTable(nil, 0)).To(Succeed())
+		blank, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+
+		// index pointing beyond the end of the table
+		val := appendUvarint(appendUvarint(nil, 6), 1<<62)
+		index := frameBlock(1, append([]byte{1, 0, byte(len(val)), 'k'}, val...))
+
+		var footer [20]byte
+		binary.BigEndian.PutUint64(footer[0:], 6)
+		binary.BigEndian.PutUint64(footer[8:], uint64(len(index)))
+		copy(footer[16:], blank[len(blank)-4:])
+
+		data := append(append([]byte{}, blank[:6]...), index...)
+		data = append(data, footer[:]...)
+		Expect(ioutil.WriteFile(path, data, 0o644)).To(Succeed())
+
+		_, err = extsort.OpenTable(path, nil)
+		Expect(err).To(MatchError(extsort.ErrCorrupt))
+	})
+
+	It("detects corruption", func() {
+		Expect(writeTable(&extsort.Options{WorkDir: workDir}, 1000)).To(Succeed())
+
+		data, err := ioutil.ReadFile(path)
+		Expect(err).NotTo(HaveOccurred())
+		data[100] ^= 0xff
+		Expect(ioutil.WriteFile(path, data, 0o644)).To(Succeed())
+
+		table, err := extsort.OpenTable(path, nil)
+		Expect(err).NotTo(HaveOccurred())
+		defer table.Close()
+
+		_, err = table.Get([]byte("k000000"))
+		Expect(err).To(MatchError(extsort.ErrCorrupt))
+		Expect(table.Get([]byte("k001998"))).To(Equal([]byte("v321")))
+	})
+})
@@ -1,21 +1,22 @@
 package extsort
 
 import (
-	"bufio"
-	"encoding/binary"
 	"io"
 	"os"
 )
 
 type tempWriter struct {
 	f        *os.File
-	c        compressedWriter
-	w        *bufio.Writer
+	bw       *blockFileWriter
 	keepFile bool
 
-	scratch []byte
-	offsets []int64
-	size    int64
+	offset int64 // start of the current run
+}
+
+// tempRun is the position of a run within a temporary file.
+type tempRun struct {
+	ra           io.ReaderAt
+	offset, size int64
 }
 
 func newTempWriter(dir string, compress Compression, keepFile bool) (*tempWriter, error) {
@@ -24,143 +25,79 @@ func newTempWriter(dir string, compress Compression, keepFile bool) (*tempWriter
 		return nil, err
 	}
 
-	c := compress.newWriter(f)
-	w := bufio.NewWriterSize(c, 1<<16) // 64k
-	return &tempWriter{f: f, c: c, w: w, scratch: make([]byte, binary.MaxVarintLen64), keepFile: keepFile}, nil
-}
-
-func (t *tempWriter) ReaderAt() io.ReaderAt {
-	return t.f
+	return &tempWriter{f: f, bw: newRunBlockWriter(f, compress), keepFile: keepFile}, nil
 }
 
-func (t *tempWriter) Encode(ent *entry) error {
-	if err := t.encodeSize(ent.keyLen); err != nil {
-		return err
-	}
-	if err := t.encodeSize(ent.ValLen()); err != nil {
-		return err
-	}
-	if _, err := t.Write(ent.data); err != nil {
-		return err
-	}
-	return nil
+func (t *tempWriter) Encode(key, val []byte) error {
+	return t.bw.Add(key, val)
 }
 
-func (t *tempWriter) Write(p []byte) (int, error) {
-	n, err := t.w.Write(p)
-	t.size += int64(n)
-	return n, err
+// EncodeKind writes a record of the given kind.
+func (t *tempWriter) EncodeKind(kind recordKind, key, val []byte) error {
+	return t.bw.AddKind(kind, key, val)
 }
 
-func (t *tempWriter) Flush() error {
-	if err := t.w.Flush(); err != nil {
-		return err
-	}
-	if err := t.c.Close(); err != nil {
-		return err
+// Flush completes the current run and returns its position.
+func (t *tempWriter) Flush() (tempRun, error) {
+	if err := t.bw.Close(); err != nil {
+		return tempRun{}, err
 	}
 
 	pos, err := t.f.Seek(0, io.SeekCurrent)
 	if err != nil {
-		return err
+		return tempRun{}, err
 	}
 
-	t.offsets = append(t.offsets, pos)
-	t.c.Reset(t.f)
-	t.w.Reset(t.c)
+	run := tempRun{ra: t.f, offset: t.offset, size: pos - t.offset}
+	t.offset = pos
+	t.bw.Reset(t.f)
 
-	return nil
+	return run, nil
 }
 
-func (t *tempWriter) Close() (err error) {
-	if e := t.c.Close(); e != nil {
-		err = e
-	}
-	if e := closeTempFile(t.f, t.keepFile); e != nil {
-		err = e
+// Reset truncates the file, discarding all runs.
+func (t *tempWriter) Reset() error {
+	if err := t.f.Truncate(0); err != nil {
+		return err
 	}
-	return
-}
-
-func (t *tempWriter) encodeSize(sz int) error {
-	n := binary.PutUvarint(t.scratch, uint64(sz))
-	if _, err := t.Write(t.scratch[:n]); err != nil {
+	if _, err := t.f.Seek(0, io.SeekStart); err != nil {
 		return err
 	}
+
+	t.offset = 0
+	t.bw.Truncate(t.f)
 	return nil
 }
 
+func (t *tempWriter) Close() error {
+	return closeTempFile(t.f, t.keepFile)
+}
+
 func (t *tempWriter) Size() int64 {
-	return t.size
+	return t.bw.Size()
 }
 
 // --------------------------------------------------------------------
 
-type tempReader struct {
-	readers  []io.ReadCloser
-	sections []*bufio.Reader
-}
-
-func newTempReader(ra io.ReaderAt, offsets []int64, bufSize int, compress Compression) (*tempReader, error) {
-	r := &tempReader{
-		readers:  make([]io.ReadCloser, 0, len(offsets)),
-		sections: make([]*bufio.Reader, 0, len(offsets)),
-	}
-	slimit := bufSize / (len(offsets) + 1)
-	offset := int64(0)
-	for _, next := range offsets {
-		crd, err := compress.newReader(io.NewSectionReader(ra, offset, next-offset))
+// newTempReaders opens the given runs. If readAhead is positive, each
+// reader decodes up to readAhead blocks in the background.
+func newTempReaders(runs []tempRun, readAhead int) ([]section, error) {
+	readers := make([]section, 0, len(runs))
+	for _, run := range runs {
+		dec, err := newRunDecoder(io.NewSectionReader(run.ra, run.offset, run.size))
 		if err != nil {
-			_ = r.Close()
+			for _, r := range readers {
+				_ = r.Close()
+			}
 			return nil, err
 		}
-		r.sections = append(r.sections, bufio.NewReaderSize(crd, slimit))
-		r.readers = append(r.readers, crd)
-		offset = next
-	}
-
-	return r, nil
-}
-
-func (t *tempReader) NumSections() int {
-	return len(t.sections)
-}
-
-func (t *tempReader) ReadNext(section int) (*entry, error) {
-	r := t.sections[section]
-	if r == nil {
-		return nil, nil
+		readers = append(readers, dec)
 	}
 
-	ku, err := binary.ReadUvarint(r)
-	if err == io.EOF {
-		t.sections[section] = nil
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	vu, err := binary.ReadUvarint(r)
-	if err == io.EOF {
-		t.sections[section] = nil
-		return nil, nil
-	} else if err != nil {
-		return nil, err
-	}
-
-	ent := fetchEntry(int(ku), int(vu))
-	if _, err := io.ReadFull(r, ent.data); err != nil {
-		ent.Release()
-		return nil, err
-	}
-	return ent, nil
-}
-
-func (t *tempReader) Close() (err error) {
-	for _, crd := range t.readers {
-		if e := crd.Close(); e != nil {
-			err = e
+	if readAhead > 0 {
+		for _, r := range readers {
+			r.(*runDecoder).ReadAhead(readAhead)
 		}
 	}
-	return
+	return readers, nil
 }
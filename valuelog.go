@@ -0,0 +1,148 @@
+package extsort
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"sync"
+)
+
+// valueLog stores large values in a temporary file, so only pointers need
+// to be sorted. It is safe for concurrent use.
+type valueLog struct {
+	dir      string
+	keepFile bool
+
+	mu     sync.Mutex
+	f      *os.File
+	offset int64
+}
+
+func newValueLog(dir string, keepFile bool) *valueLog {
+	return &valueLog{dir: dir, keepFile: keepFile}
+}
+
+// Write appends a value, read from r, and returns a pointer to it.
+func (l *valueLog) Write(r io.Reader) ([]byte, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		f, err := newTempFile(l.dir, "extsort-values", l.keepFile)
+		if err != nil {
+			return nil, err
+		}
+		l.f = f
+	}
+
+	n, err := io.Copy(l.f, r)
+	if err != nil {
+		// discard the partial value
+		if _, e := l.f.Seek(l.offset, io.SeekStart); e == nil {
+			_ = l.f.Truncate(l.offset)
+		}
+		return nil, err
+	}
+
+	ptr := appendValuePointer(nil, l.offset, n)
+	l.offset += n
+	return ptr, nil
+}
+
+// Reader returns a reader for the value at ptr.
+func (l *valueLog) Reader(ptr []byte) (*io.SectionReader, error) {
+	offset, size, ok := decodeValuePointer(ptr)
+	if !ok {
+		return nil, ErrCorrupt
+	}
+
+	l.mu.Lock()
+	f := l.f
+	l.mu.Unlock()
+
+	if f == nil {
+		return nil, ErrCorrupt
+	}
+	return io.NewSectionReader(f, offset, size), nil
+}
+
+// ReadValue reads the value at ptr into dst.
+func (l *valueLog) ReadValue(dst, ptr []byte) ([]byte, error) {
+	r, err := l.Reader(ptr)
+	if err != nil {
+		return dst, err
+	}
+
+	n := int(r.Size())
+	if cap(dst) < n {
+		dst = make([]byte, n)
+	} else {
+		dst = dst[:n]
+	}
+	if n == 0 {
+		return dst, nil
+	}
+	if _, err := r.ReadAt(dst, 0); err != nil {
+		return dst[:0], unexpectedEOF(err)
+	}
+	return dst, nil
+}
+
+// Size returns the number of bytes written.
+func (l *valueLog) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.offset
+}
+
+// Reset truncates the log.
+func (l *valueLog) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	if err := l.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := l.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	l.offset = 0
+	return nil
+}
+
+// Close removes the log.
+func (l *valueLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.f == nil {
+		return nil
+	}
+	err := closeTempFile(l.f, l.keepFile)
+	l.f = nil
+	l.offset = 0
+	return err
+}
+
+func appendValuePointer(dst []byte, offset, size int64) []byte {
+	var scratch [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(scratch[:], uint64(offset))
+	n += binary.PutUvarint(scratch[n:], uint64(size))
+	return append(dst, scratch[:n]...)
+}
+
+func decodeValuePointer(ptr []byte) (int64, int64, bool) {
+	offset, n := binary.Uvarint(ptr)
+	if n <= 0 {
+		return 0, 0, false
+	}
+	size, m := binary.Uvarint(ptr[n:])
+	if m <= 0 || n+m != len(ptr) {
+		return 0, 0, false
+	}
+	return int64(offset), int64(size), true
+}